@@ -0,0 +1,207 @@
+package kvdroid
+
+import (
+	"bytes"
+	"compress/flate"
+	"io"
+	"math"
+)
+
+const defaultStorageBlockSize = 64 * 1024
+
+// blob is a byte value stored compressed by blocks, so that a range only
+// needs to decompress and recompress the blocks it overlaps
+type blob struct {
+	size      int
+	blockSize int
+	blocks    []block
+	// stored is the total size of the blocks
+	stored int
+}
+
+// block is a slice of a blob, deflated unless that did not shrink it
+type block struct {
+	data     []byte
+	deflated bool
+	// crc is the CRC32C of the uncompressed content
+	crc uint32
+}
+
+func newBlob(data []byte, blockSize int) *blob {
+	v := &blob{size: len(data), blockSize: blockSize}
+	for i := 0; i*blockSize < len(data); i++ {
+		v.blocks = append(v.blocks, block{})
+		v.setBlock(i, data[i*blockSize:i*blockSize+v.blockLen(i)])
+	}
+	return v
+}
+
+// blockLen returns the uncompressed length of block i
+func (v *blob) blockLen(i int) int {
+	if end := (i + 1) * v.blockSize; end < v.size {
+		return v.blockSize
+	}
+	return v.size - i*v.blockSize
+}
+
+// block returns the uncompressed content of block i and whether it matches
+// its checksum. The writes ignore a mismatch, as they set a new checksum.
+func (v *blob) block(i int) ([]byte, bool) {
+	b := v.blocks[i]
+	data := b.data
+	if b.deflated {
+		data = make([]byte, v.blockLen(i))
+		_, err := io.ReadFull(flate.NewReader(bytes.NewReader(b.data)), data)
+		if err != nil {
+			return data, false
+		}
+	}
+	return data, CRC32C(data) == b.crc
+}
+
+func (v *blob) setBlock(i int, data []byte) {
+	v.stored -= len(v.blocks[i].data)
+	if deflated := deflate(data); deflated != nil {
+		v.blocks[i] = block{data: deflated, deflated: true}
+	} else {
+		v.blocks[i] = block{data: data}
+	}
+	v.blocks[i].crc = CRC32C(data)
+	v.stored += len(v.blocks[i].data)
+}
+
+// resize truncates the blob or extends it with zeros
+func (v *blob) resize(size int) {
+	n := (size + v.blockSize - 1) / v.blockSize
+	keep := len(v.blocks)
+	if n < keep {
+		for _, b := range v.blocks[n:] {
+			v.stored -= len(b.data)
+		}
+		keep = n
+		v.blocks = v.blocks[:n]
+	}
+	var last []byte
+	if keep > 0 {
+		last, _ = v.block(keep - 1)
+	}
+	v.size = size
+	if keep > 0 && len(last) != v.blockLen(keep-1) {
+		data := make([]byte, v.blockLen(keep-1))
+		copy(data, last)
+		v.setBlock(keep-1, data)
+	}
+	for i := keep; i < n; i++ {
+		v.blocks = append(v.blocks, block{})
+		v.setBlock(i, make([]byte, v.blockLen(i)))
+	}
+}
+
+// readAt returns the bytes [start, end) of the blob, or false if one of the
+// blocks they overlap does not match its checksum
+func (v *blob) readAt(start, end int) ([]byte, bool) {
+	data := make([]byte, end-start)
+	for i := start / v.blockSize; i*v.blockSize < end; i++ {
+		blockStart := i * v.blockSize
+		src, ok := v.block(i)
+		if !ok {
+			return nil, false
+		}
+		if start > blockStart {
+			src = src[start-blockStart:]
+		}
+		if blockStart > start {
+			copy(data[blockStart-start:], src)
+		} else {
+			copy(data, src)
+		}
+	}
+	return data, true
+}
+
+// writeAt copies data at offset start, extending the blob with zeros if
+// needed
+func (v *blob) writeAt(data []byte, start int) {
+	end := start + len(data)
+	if end > v.size {
+		v.resize(end)
+	}
+	for i := start / v.blockSize; i*v.blockSize < end; i++ {
+		blockStart := i * v.blockSize
+		dst, _ := v.block(i)
+		if start > blockStart {
+			copy(dst[start-blockStart:], data)
+		} else {
+			copy(dst, data[blockStart-start:])
+		}
+		v.setBlock(i, dst)
+	}
+}
+
+// sizeOf returns the length of the byte value of key
+func (b *Bucket) sizeOf(key string) (uint32, bool) {
+	if v, ok := b.blobs[key]; ok {
+		return uint32(v.size), true
+	}
+	data, ok := b.bytedata[key]
+	return uint32(len(data)), ok
+}
+
+// bytesOf returns the byte value of key, decompressing it if needed. An
+// uncompressed value is returned as is and must not be modified.
+func (b *Bucket) bytesOf(key string) ([]byte, bool) {
+	return b.rangeOf(key, 0, math.MaxUint32)
+}
+
+// rangeOf returns the bytes [start, end) of the byte value of key, with the
+// range truncated to the size of the value
+func (b *Bucket) rangeOf(key string, start, end uint32) ([]byte, bool) {
+	size, ok := b.sizeOf(key)
+	if !ok {
+		return nil, false
+	}
+	if end > size {
+		end = size
+	}
+	if start > end {
+		start = end
+	}
+	// a corrupted value is not returned, see replyCorrupted
+	if v, ok := b.blobs[key]; ok {
+		data, ok := v.readAt(int(start), int(end))
+		if !ok {
+			panic(corruptedError(key))
+		}
+		return data, true
+	}
+	data := b.bytedata[key]
+	if CRC32C(data) != b.meta[key].crc {
+		panic(corruptedError(key))
+	}
+	return data[start:end], true
+}
+
+func (b *Bucket) addBlob(key string, v *blob) {
+	b.blobs[key] = v
+	b.packedBytes += int64(v.size)
+	b.packedSize += int64(v.stored)
+}
+
+func (b *Bucket) dropBlob(key string) {
+	if v, ok := b.blobs[key]; ok {
+		b.packedBytes -= int64(v.size)
+		b.packedSize -= int64(v.stored)
+		delete(b.blobs, key)
+	}
+}
+
+// updateBlob modifies the compressed value of key with update, it must be
+// called with the write lock held
+func (b *Bucket) updateBlob(key string, v *blob, update func(v *blob)) {
+	b.dropBlob(key)
+	size := v.size
+	update(v)
+	b.addBytes(int64(v.size - size))
+	b.addBlob(key, v)
+	b.touch(key)
+}
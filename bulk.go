@@ -0,0 +1,79 @@
+package kvdroid
+
+import (
+	"crypto/subtle"
+	"net"
+	"strings"
+	"sync/atomic"
+)
+
+// flush deletes all the values of the bucket and returns the number of keys
+// deleted, it must be called with the write lock held. Locks are kept.
+func (b *Bucket) flush() int {
+	n := len(b.meta)
+	atomic.AddInt64(&b.usage.keys, -int64(n))
+	b.addBytes(-b.nbytes)
+	b.bytedata = make(map[string][]byte)
+	b.blobs = make(map[string]*blob)
+	b.packedBytes = 0
+	b.packedSize = 0
+	b.flushes++
+	b.uintdata = make(map[string]uint32)
+	b.uint64data = make(map[string]uint64)
+	b.int64data = make(map[string]int64)
+	b.meta = make(map[string]*keyMeta)
+	if n > 0 {
+		b.version++
+		b.deleted = b.version
+	}
+	for key := range b.waiters {
+		b.wake(key)
+	}
+	return n
+}
+
+// DelKeys deletes all the values of the keys with a prefix and matching a
+// glob pattern, if not empty, bucket by bucket.
+func (s *Store) DelKeys(conn net.Conn) {
+	prefix, err := readString(conn)
+	check(err)
+	match, err := readString(conn)
+	check(err)
+
+	ns := namespaceOf(conn)
+	var deleted uint32
+	for _, bucket := range ns.buckets {
+		bucket.lock()
+		for key := range bucket.meta {
+			if !strings.HasPrefix(key, prefix) {
+				continue
+			}
+			if match != "" && !matchGlob(match, key) {
+				continue
+			}
+			bucket.del(key, TypeAny)
+			notify(conn, EventDel, key)
+			deleted++
+		}
+		bucket.unlock()
+	}
+	try(sendMessage(conn, ackReply))
+	try(sendUint32(conn, deleted))
+}
+
+// FlushAll empties all the namespaces of the store, it requires the admin
+// token of the server.
+func (s *Store) FlushAll(conn net.Conn) {
+	token, err := readString(conn)
+	check(err)
+	if s.adminToken == "" || subtle.ConstantTimeCompare([]byte(token), []byte(s.adminToken)) != 1 {
+		try(sendMessage(conn, errPermissionDeniedReply))
+		return
+	}
+	var n int
+	for _, ns := range s.sortedNamespaces() {
+		n += ns.flush(conn)
+	}
+	try(sendMessage(conn, ackReply))
+	try(sendUint32(conn, uint32(n)))
+}
@@ -0,0 +1,75 @@
+package kvdroid
+
+import (
+	"hash/crc32"
+	"log"
+	"net"
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// CRC32C returns the CRC-32 checksum of data with the Castagnoli
+// polynomial, as computed by the server. It is hardware accelerated on most
+// platforms. The server also keeps the checksum of each byte value, or of
+// each block of a compressed value, and checks it on every read.
+func CRC32C(data []byte) uint32 {
+	return crc32.Checksum(data, castagnoli)
+}
+
+// corruptedError is raised by the reads of a byte value which does not match
+// its checksum anymore
+type corruptedError string
+
+func (e corruptedError) Error() string {
+	return "Corrupted byte value of key " + string(e)
+}
+
+// replyCorrupted replies errChecksumMismatchReply to a command which read a
+// corrupted byte value, it is deferred by execute. The values are read before
+// any reply is sent or any value is modified.
+func replyCorrupted(conn net.Conn) {
+	r := recover()
+	if r == nil {
+		return
+	}
+	err, ok := r.(corruptedError)
+	if !ok {
+		panic(r)
+	}
+	log.Printf("%v", err)
+	try(sendMessage(conn, errChecksumMismatchReply))
+}
+
+// SetBytesChecked ...
+func (s *Store) SetBytesChecked(bucket *Bucket, key string, conn net.Conn) {
+	crc, err := readUint32(conn)
+	check(err)
+	data, err := readBytes(conn)
+	check(err)
+	if CRC32C(data) != crc {
+		try(sendMessage(conn, errChecksumMismatchReply))
+	} else if !bucket.allows(key, uint32(len(data))) {
+		try(sendMessage(conn, errQuotaExceededReply))
+	} else {
+		bucket.setBytes(key, data)
+		notify(conn, EventSet, key)
+		try(sendMessage(conn, ackReply))
+	}
+}
+
+// Checksum ...
+func (s *Store) Checksum(bucket *Bucket, key string, conn net.Conn) {
+	start, err := readUint32(conn)
+	check(err)
+	end, err := readUint32(conn)
+	check(err)
+	end++ // end is the last byte included, like in GetBytesRange
+	// the range is truncated to actual size
+	data, ok := bucket.rangeOf(key, start, end)
+	if !ok {
+		try(sendMessage(conn, errNoKeyReply))
+	} else {
+		try(sendMessage(conn, ackReply))
+		try(sendUint32(conn, CRC32C(data)))
+	}
+}
@@ -1,29 +1,103 @@
 package kvdroid
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"net"
+	"time"
 )
 
 var (
 	// ErrKeyNotFound is raised when the key requested by the client is not found
 	ErrKeyNotFound = errors.New("key not found")
+	// ErrReservedChannel is raised when publishing on a keyspace channel
+	ErrReservedChannel = errors.New("reserved channel")
+	// ErrTimeout is raised when a wait command times out
+	ErrTimeout = errors.New("timeout")
+	// ErrLocked is raised when a lock is held by someone else
+	ErrLocked = errors.New("locked")
+	// ErrLockLost is raised when a lock is not held with the given token
+	ErrLockLost = errors.New("lock lost")
+	// ErrTxAborted is raised when a watched key was modified before a
+	// transaction ran
+	ErrTxAborted = errors.New("transaction aborted")
+	// ErrTxInvalid is raised when a transaction holds a command not allowed
+	// in transactions or malformed arguments
+	ErrTxInvalid = errors.New("invalid transaction")
+	// ErrVersionConflict is raised when a conditional write finds another
+	// version of the key
+	ErrVersionConflict = errors.New("version conflict")
+	// ErrChecksumMismatch is raised when the server receives data which does
+	// not match its checksum, or reads a stored byte value which does not
+	// match its checksum anymore
+	ErrChecksumMismatch = errors.New("checksum mismatch")
+	// ErrPermissionDenied is raised when an admin command is called without
+	// the admin token of the server
+	ErrPermissionDenied = errors.New("permission denied")
+	// ErrQuotaExceeded is raised when a write would exceed the quota of the
+	// namespace
+	ErrQuotaExceeded = errors.New("quota exceeded")
+	// ErrKeyExists is raised when the destination of RenameIfNotExists
+	// already holds a value
+	ErrKeyExists = errors.New("key exists")
 )
 
 // Client ...
 type Client struct {
+	addr string
 	conn net.Conn
 }
 
+// ClientOptions ...
+type ClientOptions struct {
+	// CompressionThreshold is the size from which byte payloads are
+	// compressed, if the server enables compression too. The server may
+	// raise it, 0 disables compression.
+	CompressionThreshold int
+	// Namespace is the namespace selected on connection, the default one
+	// if empty
+	Namespace string
+}
+
 // NewClient ...
 func NewClient(addr string) *Client {
+	return NewClientWithOptions(addr, &ClientOptions{})
+}
+
+// NewClientWithOptions ...
+func NewClientWithOptions(addr string, opt *ClientOptions) *Client {
 	conn, err := net.Dial("tcp", addr)
 	check(err)
-	return &Client{
+	c := &Client{
+		addr: addr,
 		conn: conn,
 	}
+	if opt.CompressionThreshold > 0 {
+		c.hello(opt)
+	}
+	if opt.Namespace != "" {
+		try(c.Select(opt.Namespace))
+	}
+	return c
+}
+
+// hello negotiates the options of the connection with the server
+func (c *Client) hello(opt *ClientOptions) {
+	try(sendMessage(c.conn, helloCmd))
+	try(sendUint32(c.conn, uint32(opt.CompressionThreshold)))
+	reply, err := readMessage(c.conn)
+	check(err)
+	switch reply {
+	case ackReply:
+		threshold, err := readUint32(c.conn)
+		check(err)
+		c.conn = &clientConn{Conn: c.conn, threshold: int(threshold)}
+	default:
+		panic(fmt.Errorf("Server error: %s", string(reply)))
+	}
 }
 
 // Close ...
@@ -53,6 +127,8 @@ func (c *Client) GetBytes(key string) ([]byte, error) {
 	switch reply {
 	case errNoKeyReply:
 		return nil, ErrKeyNotFound
+	case errChecksumMismatchReply:
+		return nil, ErrChecksumMismatch
 	case ackReply:
 		data, err := readBytes(c.conn)
 		check(err)
@@ -72,6 +148,8 @@ func (c *Client) GetBytesInto(key string, dst []byte) (uint32, error) {
 	switch reply {
 	case errNoKeyReply:
 		return 0, ErrKeyNotFound
+	case errChecksumMismatchReply:
+		return 0, ErrChecksumMismatch
 	case ackReply:
 		n, err := readBytesInto(c.conn, dst)
 		if err != nil && err != io.EOF {
@@ -94,6 +172,8 @@ func (c *Client) GetBytesRange(key string, start, end uint32) ([]byte, error) {
 	switch reply {
 	case errNoKeyReply:
 		return nil, ErrKeyNotFound
+	case errChecksumMismatchReply:
+		return nil, ErrChecksumMismatch
 	case ackReply:
 		data, err := readBytes(c.conn)
 		check(err)
@@ -115,6 +195,8 @@ func (c *Client) GetBytesRangeInto(key string, start, end uint32, dst []byte) (u
 	switch reply {
 	case errNoKeyReply:
 		return 0, ErrKeyNotFound
+	case errChecksumMismatchReply:
+		return 0, ErrChecksumMismatch
 	case ackReply:
 		n, err := readBytesInto(c.conn, dst)
 		if err != nil && err != io.EOF {
@@ -126,23 +208,27 @@ func (c *Client) GetBytesRangeInto(key string, start, end uint32, dst []byte) (u
 	}
 }
 
-// SetBytes ...
-func (c *Client) SetBytes(key string, data []byte) {
+// SetBytes sets the byte value of key. It returns ErrQuotaExceeded if the
+// quota of the namespace does not allow it.
+func (c *Client) SetBytes(key string, data []byte) error {
 	try(sendMessage(c.conn, setBytesCmd))
 	try(sendBytes(c.conn, []byte(key)))
 	try(sendBytes(c.conn, data))
 	reply, err := readMessage(c.conn)
 	check(err)
 	switch reply {
+	case errQuotaExceededReply:
+		return ErrQuotaExceeded
 	case ackReply:
-		return
+		return nil
 	default:
 		panic(fmt.Errorf("Server error: %s", string(reply)))
 	}
 }
 
-// SetBytesRange ...
-func (c *Client) SetBytesRange(key string, start uint32, data []byte) {
+// SetBytesRange writes data at offset start of the byte value of key. It
+// returns ErrQuotaExceeded if the quota of the namespace does not allow it.
+func (c *Client) SetBytesRange(key string, start uint32, data []byte) error {
 	try(sendMessage(c.conn, setBytesRangeCmd))
 	try(sendBytes(c.conn, []byte(key)))
 	try(sendUint32(c.conn, start))
@@ -150,8 +236,10 @@ func (c *Client) SetBytesRange(key string, start uint32, data []byte) {
 	reply, err := readMessage(c.conn)
 	check(err)
 	switch reply {
+	case errQuotaExceededReply:
+		return ErrQuotaExceeded
 	case ackReply:
-		return
+		return nil
 	default:
 		panic(fmt.Errorf("Server error: %s", string(reply)))
 	}
@@ -190,16 +278,50 @@ func (c *Client) TruncateBytes(key string, size uint32) error {
 	}
 }
 
-// SetUint ...
-func (c *Client) SetUint(key string, val uint32) {
+// AppendBytes appends data to the byte value of key, which is created if
+// missing, and returns the new length of the value. It returns
+// ErrQuotaExceeded if the quota of the namespace does not allow it.
+func (c *Client) AppendBytes(key string, data []byte) (uint32, error) {
+	try(sendMessage(c.conn, appendBytesCmd))
+	try(sendBytes(c.conn, []byte(key)))
+	try(sendBytes(c.conn, data))
+	reply, err := readMessage(c.conn)
+	check(err)
+	switch reply {
+	case errQuotaExceededReply:
+		return 0, ErrQuotaExceeded
+	case ackReply:
+		size, err := readUint32(c.conn)
+		check(err)
+		return size, nil
+	default:
+		panic(fmt.Errorf("Server error: %s", string(reply)))
+	}
+}
+
+// AppendBytesReturnOffset appends data to the byte value of key, like
+// AppendBytes, and returns the offset at which data was written.
+func (c *Client) AppendBytesReturnOffset(key string, data []byte) (uint32, error) {
+	size, err := c.AppendBytes(key, data)
+	if err != nil {
+		return 0, err
+	}
+	return size - uint32(len(data)), nil
+}
+
+// SetUint sets the uint value of key. It returns ErrQuotaExceeded if the
+// key quota of the namespace does not allow creating key.
+func (c *Client) SetUint(key string, val uint32) error {
 	try(sendMessage(c.conn, setUintCmd))
 	try(sendBytes(c.conn, []byte(key)))
 	try(sendUint32(c.conn, val))
 	reply, err := readMessage(c.conn)
 	check(err)
 	switch reply {
+	case errQuotaExceededReply:
+		return ErrQuotaExceeded
 	case ackReply:
-		return
+		return nil
 	default:
 		panic(fmt.Errorf("Server error: %s", string(reply)))
 	}
@@ -223,16 +345,19 @@ func (c *Client) GetUint(key string) (uint32, error) {
 	}
 }
 
-// SetUintIfMax ...
-func (c *Client) SetUintIfMax(key string, val uint32) {
+// SetUintIfMax sets the uint value of key to val if it is greater or if
+// the key is missing. It returns ErrQuotaExceeded like SetUint.
+func (c *Client) SetUintIfMax(key string, val uint32) error {
 	try(sendMessage(c.conn, setUintIfMaxCmd))
 	try(sendBytes(c.conn, []byte(key)))
 	try(sendUint32(c.conn, val))
 	reply, err := readMessage(c.conn)
 	check(err)
 	switch reply {
+	case errQuotaExceededReply:
+		return ErrQuotaExceeded
 	case ackReply:
-		return
+		return nil
 	default:
 		panic(fmt.Errorf("Server error: %s", string(reply)))
 	}
@@ -253,3 +378,1095 @@ func (c *Client) DelUint(key string) error {
 		panic(fmt.Errorf("Server error: %s", string(reply)))
 	}
 }
+
+// AddUint adds delta to the value of key and returns the new value.
+// A missing key is created with delta as value, unless the key quota of the
+// namespace does not allow it and ErrQuotaExceeded is returned. The addition
+// wraps around on overflow.
+func (c *Client) AddUint(key string, delta uint32) (uint32, error) {
+	try(sendMessage(c.conn, addUintCmd))
+	try(sendBytes(c.conn, []byte(key)))
+	try(sendUint32(c.conn, delta))
+	reply, err := readMessage(c.conn)
+	check(err)
+	switch reply {
+	case errQuotaExceededReply:
+		return 0, ErrQuotaExceeded
+	case ackReply:
+		val, err := readUint32(c.conn)
+		check(err)
+		return val, nil
+	default:
+		panic(fmt.Errorf("Server error: %s", string(reply)))
+	}
+}
+
+// IncrUint increments the value of key by one and returns the new value.
+func (c *Client) IncrUint(key string) (uint32, error) {
+	return c.AddUint(key, 1)
+}
+
+// DecrUint decrements the value of key by one and returns the new value.
+func (c *Client) DecrUint(key string) (uint32, error) {
+	// adding the max uint32 is a decrement modulo 2^32
+	return c.AddUint(key, ^uint32(0))
+}
+
+// SetUintIfMin sets the uint value of key to val if it is lower or if the
+// key is missing. It returns ErrQuotaExceeded like SetUint.
+func (c *Client) SetUintIfMin(key string, val uint32) error {
+	try(sendMessage(c.conn, setUintIfMinCmd))
+	try(sendBytes(c.conn, []byte(key)))
+	try(sendUint32(c.conn, val))
+	reply, err := readMessage(c.conn)
+	check(err)
+	switch reply {
+	case errQuotaExceededReply:
+		return ErrQuotaExceeded
+	case ackReply:
+		return nil
+	default:
+		panic(fmt.Errorf("Server error: %s", string(reply)))
+	}
+}
+
+// CompareAndSwapUint sets key to val if its current value is old.
+// It returns true if the swap happened.
+func (c *Client) CompareAndSwapUint(key string, old, val uint32) (bool, error) {
+	try(sendMessage(c.conn, compareAndSwapUintCmd))
+	try(sendBytes(c.conn, []byte(key)))
+	try(sendUint32(c.conn, old))
+	try(sendUint32(c.conn, val))
+	reply, err := readMessage(c.conn)
+	check(err)
+	switch reply {
+	case errNoKeyReply:
+		return false, ErrKeyNotFound
+	case ackReply:
+		swapped, err := readBool(c.conn)
+		check(err)
+		return swapped, nil
+	default:
+		panic(fmt.Errorf("Server error: %s", string(reply)))
+	}
+}
+
+// GetAndSetUint sets key to val and returns its previous value.
+// If the key did not exist, it is still set and ErrKeyNotFound is returned.
+func (c *Client) GetAndSetUint(key string, val uint32) (uint32, error) {
+	try(sendMessage(c.conn, getAndSetUintCmd))
+	try(sendBytes(c.conn, []byte(key)))
+	try(sendUint32(c.conn, val))
+	reply, err := readMessage(c.conn)
+	check(err)
+	switch reply {
+	case errNoKeyReply:
+		return 0, ErrKeyNotFound
+	case errQuotaExceededReply:
+		return 0, ErrQuotaExceeded
+	case ackReply:
+		old, err := readUint32(c.conn)
+		check(err)
+		return old, nil
+	default:
+		panic(fmt.Errorf("Server error: %s", string(reply)))
+	}
+}
+
+// SetUint64 sets the uint64 value of key. It returns ErrQuotaExceeded like
+// SetUint.
+func (c *Client) SetUint64(key string, val uint64) error {
+	try(sendMessage(c.conn, setUint64Cmd))
+	try(sendBytes(c.conn, []byte(key)))
+	try(sendUint64(c.conn, val))
+	reply, err := readMessage(c.conn)
+	check(err)
+	switch reply {
+	case errQuotaExceededReply:
+		return ErrQuotaExceeded
+	case ackReply:
+		return nil
+	default:
+		panic(fmt.Errorf("Server error: %s", string(reply)))
+	}
+}
+
+// GetUint64 ...
+func (c *Client) GetUint64(key string) (uint64, error) {
+	try(sendMessage(c.conn, getUint64Cmd))
+	try(sendBytes(c.conn, []byte(key)))
+	reply, err := readMessage(c.conn)
+	check(err)
+	switch reply {
+	case errNoKeyReply:
+		return 0, ErrKeyNotFound
+	case ackReply:
+		val, err := readUint64(c.conn)
+		check(err)
+		return val, nil
+	default:
+		panic(fmt.Errorf("Server error: %s", string(reply)))
+	}
+}
+
+// SetUint64IfMax is SetUintIfMax for uint64 values.
+func (c *Client) SetUint64IfMax(key string, val uint64) error {
+	try(sendMessage(c.conn, setUint64IfMaxCmd))
+	try(sendBytes(c.conn, []byte(key)))
+	try(sendUint64(c.conn, val))
+	reply, err := readMessage(c.conn)
+	check(err)
+	switch reply {
+	case errQuotaExceededReply:
+		return ErrQuotaExceeded
+	case ackReply:
+		return nil
+	default:
+		panic(fmt.Errorf("Server error: %s", string(reply)))
+	}
+}
+
+// AddUint64 is AddUint for uint64 values.
+func (c *Client) AddUint64(key string, delta uint64) (uint64, error) {
+	try(sendMessage(c.conn, addUint64Cmd))
+	try(sendBytes(c.conn, []byte(key)))
+	try(sendUint64(c.conn, delta))
+	reply, err := readMessage(c.conn)
+	check(err)
+	switch reply {
+	case errQuotaExceededReply:
+		return 0, ErrQuotaExceeded
+	case ackReply:
+		val, err := readUint64(c.conn)
+		check(err)
+		return val, nil
+	default:
+		panic(fmt.Errorf("Server error: %s", string(reply)))
+	}
+}
+
+// DelUint64 ...
+func (c *Client) DelUint64(key string) error {
+	try(sendMessage(c.conn, delUint64Cmd))
+	try(sendBytes(c.conn, []byte(key)))
+	reply, err := readMessage(c.conn)
+	check(err)
+	switch reply {
+	case errNoKeyReply:
+		return ErrKeyNotFound
+	case ackReply:
+		return nil
+	default:
+		panic(fmt.Errorf("Server error: %s", string(reply)))
+	}
+}
+
+// SetInt64 sets the int64 value of key. It returns ErrQuotaExceeded like
+// SetUint.
+func (c *Client) SetInt64(key string, val int64) error {
+	try(sendMessage(c.conn, setInt64Cmd))
+	try(sendBytes(c.conn, []byte(key)))
+	try(sendInt64(c.conn, val))
+	reply, err := readMessage(c.conn)
+	check(err)
+	switch reply {
+	case errQuotaExceededReply:
+		return ErrQuotaExceeded
+	case ackReply:
+		return nil
+	default:
+		panic(fmt.Errorf("Server error: %s", string(reply)))
+	}
+}
+
+// GetInt64 ...
+func (c *Client) GetInt64(key string) (int64, error) {
+	try(sendMessage(c.conn, getInt64Cmd))
+	try(sendBytes(c.conn, []byte(key)))
+	reply, err := readMessage(c.conn)
+	check(err)
+	switch reply {
+	case errNoKeyReply:
+		return 0, ErrKeyNotFound
+	case ackReply:
+		val, err := readInt64(c.conn)
+		check(err)
+		return val, nil
+	default:
+		panic(fmt.Errorf("Server error: %s", string(reply)))
+	}
+}
+
+// SetInt64IfMax is SetUintIfMax for int64 values.
+func (c *Client) SetInt64IfMax(key string, val int64) error {
+	try(sendMessage(c.conn, setInt64IfMaxCmd))
+	try(sendBytes(c.conn, []byte(key)))
+	try(sendInt64(c.conn, val))
+	reply, err := readMessage(c.conn)
+	check(err)
+	switch reply {
+	case errQuotaExceededReply:
+		return ErrQuotaExceeded
+	case ackReply:
+		return nil
+	default:
+		panic(fmt.Errorf("Server error: %s", string(reply)))
+	}
+}
+
+// AddInt64 is AddUint for int64 values.
+func (c *Client) AddInt64(key string, delta int64) (int64, error) {
+	try(sendMessage(c.conn, addInt64Cmd))
+	try(sendBytes(c.conn, []byte(key)))
+	try(sendInt64(c.conn, delta))
+	reply, err := readMessage(c.conn)
+	check(err)
+	switch reply {
+	case errQuotaExceededReply:
+		return 0, ErrQuotaExceeded
+	case ackReply:
+		val, err := readInt64(c.conn)
+		check(err)
+		return val, nil
+	default:
+		panic(fmt.Errorf("Server error: %s", string(reply)))
+	}
+}
+
+// DelInt64 ...
+func (c *Client) DelInt64(key string) error {
+	try(sendMessage(c.conn, delInt64Cmd))
+	try(sendBytes(c.conn, []byte(key)))
+	reply, err := readMessage(c.conn)
+	check(err)
+	switch reply {
+	case errNoKeyReply:
+		return ErrKeyNotFound
+	case ackReply:
+		return nil
+	default:
+		panic(fmt.Errorf("Server error: %s", string(reply)))
+	}
+}
+
+// Exists returns true if key holds a value of any type.
+func (c *Client) Exists(key string) bool {
+	try(sendMessage(c.conn, existsCmd))
+	try(sendBytes(c.conn, []byte(key)))
+	reply, err := readMessage(c.conn)
+	check(err)
+	switch reply {
+	case ackReply:
+		exists, err := readBool(c.conn)
+		check(err)
+		return exists
+	default:
+		panic(fmt.Errorf("Server error: %s", string(reply)))
+	}
+}
+
+// Type returns the types of the values held by key.
+func (c *Client) Type(key string) (ValueType, error) {
+	try(sendMessage(c.conn, typeCmd))
+	try(sendBytes(c.conn, []byte(key)))
+	reply, err := readMessage(c.conn)
+	check(err)
+	switch reply {
+	case errNoKeyReply:
+		return 0, ErrKeyNotFound
+	case ackReply:
+		typ, err := readUint32(c.conn)
+		check(err)
+		return ValueType(typ), nil
+	default:
+		panic(fmt.Errorf("Server error: %s", string(reply)))
+	}
+}
+
+// SizeBytes returns the length of the byte value of key without
+// transferring it.
+func (c *Client) SizeBytes(key string) (uint32, error) {
+	try(sendMessage(c.conn, sizeBytesCmd))
+	try(sendBytes(c.conn, []byte(key)))
+	reply, err := readMessage(c.conn)
+	check(err)
+	switch reply {
+	case errNoKeyReply:
+		return 0, ErrKeyNotFound
+	case ackReply:
+		size, err := readUint32(c.conn)
+		check(err)
+		return size, nil
+	default:
+		panic(fmt.Errorf("Server error: %s", string(reply)))
+	}
+}
+
+// KeyStat describes a key. Keys do not expire, so it holds no TTL.
+type KeyStat struct {
+	// Type holds the types of the values of the key
+	Type ValueType
+	// Size is the length of the byte value of the key, if any
+	Size uint32
+	// ModTime is the last time a value of the key was modified
+	ModTime time.Time
+}
+
+// Stat ...
+func (c *Client) Stat(key string) (*KeyStat, error) {
+	try(sendMessage(c.conn, statCmd))
+	try(sendBytes(c.conn, []byte(key)))
+	reply, err := readMessage(c.conn)
+	check(err)
+	switch reply {
+	case errNoKeyReply:
+		return nil, ErrKeyNotFound
+	case ackReply:
+		typ, err := readUint32(c.conn)
+		check(err)
+		size, err := readUint32(c.conn)
+		check(err)
+		modTime, err := readInt64(c.conn)
+		check(err)
+		return &KeyStat{
+			Type:    ValueType(typ),
+			Size:    size,
+			ModTime: time.Unix(0, modTime),
+		}, nil
+	default:
+		panic(fmt.Errorf("Server error: %s", string(reply)))
+	}
+}
+
+// WaitUintAtLeast blocks until the value of key is at least n and returns
+// it, or returns ErrTimeout once timeout expires. A zero timeout waits
+// forever.
+func (c *Client) WaitUintAtLeast(key string, n uint32, timeout time.Duration) (uint32, error) {
+	try(sendMessage(c.conn, waitUintAtLeastCmd))
+	try(sendBytes(c.conn, []byte(key)))
+	try(sendUint32(c.conn, n))
+	try(sendInt64(c.conn, int64(timeout)))
+	reply, err := readMessage(c.conn)
+	check(err)
+	switch reply {
+	case errTimeoutReply:
+		return 0, ErrTimeout
+	case ackReply:
+		val, err := readUint32(c.conn)
+		check(err)
+		return val, nil
+	default:
+		panic(fmt.Errorf("Server error: %s", string(reply)))
+	}
+}
+
+// WaitUintAtMost blocks until the value of key is at most n and returns
+// it, or returns ErrTimeout once timeout expires. A zero timeout waits
+// forever.
+func (c *Client) WaitUintAtMost(key string, n uint32, timeout time.Duration) (uint32, error) {
+	try(sendMessage(c.conn, waitUintAtMostCmd))
+	try(sendBytes(c.conn, []byte(key)))
+	try(sendUint32(c.conn, n))
+	try(sendInt64(c.conn, int64(timeout)))
+	reply, err := readMessage(c.conn)
+	check(err)
+	switch reply {
+	case errTimeoutReply:
+		return 0, ErrTimeout
+	case ackReply:
+		val, err := readUint32(c.conn)
+		check(err)
+		return val, nil
+	default:
+		panic(fmt.Errorf("Server error: %s", string(reply)))
+	}
+}
+
+// WaitExists blocks until key holds a value, or returns ErrTimeout once
+// timeout expires. A zero timeout waits forever.
+func (c *Client) WaitExists(key string, timeout time.Duration) error {
+	try(sendMessage(c.conn, waitExistsCmd))
+	try(sendBytes(c.conn, []byte(key)))
+	try(sendInt64(c.conn, int64(timeout)))
+	reply, err := readMessage(c.conn)
+	check(err)
+	switch reply {
+	case errTimeoutReply:
+		return ErrTimeout
+	case ackReply:
+		return nil
+	default:
+		panic(fmt.Errorf("Server error: %s", string(reply)))
+	}
+}
+
+func (c *Client) unlink(typ ValueType, keys []string) uint32 {
+	try(sendMessage(c.conn, unlinkCmd))
+	try(sendUint32(c.conn, uint32(typ)))
+	try(sendStrings(c.conn, keys))
+	reply, err := readMessage(c.conn)
+	check(err)
+	switch reply {
+	case ackReply:
+		n, err := readUint32(c.conn)
+		check(err)
+		return n
+	default:
+		panic(fmt.Errorf("Server error: %s", string(reply)))
+	}
+}
+
+// UnlinkBytes deletes the byte values of keys and returns the number of
+// values deleted. Unlike DelBytes, the keys are deleted in one request
+// which locks each bucket once, and the memory of the values is released in
+// the background.
+func (c *Client) UnlinkBytes(keys ...string) uint32 {
+	return c.unlink(TypeBytes, keys)
+}
+
+// UnlinkUint is UnlinkBytes for uint values.
+func (c *Client) UnlinkUint(keys ...string) uint32 {
+	return c.unlink(TypeUint, keys)
+}
+
+func (c *Client) copyKey(cmd Message, typ ValueType, src, dst string) error {
+	try(sendMessage(c.conn, cmd))
+	try(sendBytes(c.conn, []byte(src)))
+	try(sendUint32(c.conn, uint32(typ)))
+	try(sendBytes(c.conn, []byte(dst)))
+	reply, err := readMessage(c.conn)
+	check(err)
+	switch reply {
+	case errNoKeyReply:
+		return ErrKeyNotFound
+	case errChecksumMismatchReply:
+		return ErrChecksumMismatch
+	case errKeyExistsReply:
+		return ErrKeyExists
+	case errQuotaExceededReply:
+		return ErrQuotaExceeded
+	case ackReply:
+		return nil
+	default:
+		panic(fmt.Errorf("Server error: %s", string(reply)))
+	}
+}
+
+// RenameBytes moves the byte value of src to dst, replacing the byte value
+// of dst, without sending it through the client. Both keys are locked
+// together, so no other client sees both or neither of them.
+func (c *Client) RenameBytes(src, dst string) error {
+	return c.copyKey(renameCmd, TypeBytes, src, dst)
+}
+
+// RenameBytesIfNotExists is RenameBytes if dst has no byte value, it returns
+// ErrKeyExists otherwise.
+func (c *Client) RenameBytesIfNotExists(src, dst string) error {
+	return c.copyKey(renameIfNotExistsCmd, TypeBytes, src, dst)
+}
+
+// CopyBytes copies the byte value of src to dst, replacing the byte value of
+// dst, without sending it through the client.
+func (c *Client) CopyBytes(src, dst string) error {
+	return c.copyKey(copyCmd, TypeBytes, src, dst)
+}
+
+// CopyRange copies the byte range [srcStart, srcEnd] of srcKey to dstKey at
+// offset dstStart, without sending it through the client, and returns the
+// number of bytes copied. Like GetBytesRange, the range is truncated to the
+// size of the value. The ranges may overlap if srcKey is dstKey.
+func (c *Client) CopyRange(srcKey string, srcStart, srcEnd uint32, dstKey string, dstStart uint32) (uint32, error) {
+	try(sendMessage(c.conn, copyRangeCmd))
+	try(sendBytes(c.conn, []byte(dstKey)))
+	try(sendUint32(c.conn, dstStart))
+	try(sendBytes(c.conn, []byte(srcKey)))
+	try(sendUint32(c.conn, srcStart))
+	try(sendUint32(c.conn, srcEnd))
+	return c.readSizeReply()
+}
+
+// Concat sets the byte value of dstKey to the concatenation of the byte
+// values of srcKeys, which may include dstKey, and returns its length. It
+// returns ErrKeyNotFound if one of srcKeys has no byte value, leaving dstKey
+// untouched.
+func (c *Client) Concat(dstKey string, srcKeys ...string) (uint32, error) {
+	try(sendMessage(c.conn, concatCmd))
+	try(sendBytes(c.conn, []byte(dstKey)))
+	try(sendStrings(c.conn, srcKeys))
+	return c.readSizeReply()
+}
+
+func (c *Client) readSizeReply() (uint32, error) {
+	reply, err := readMessage(c.conn)
+	check(err)
+	switch reply {
+	case errNoKeyReply:
+		return 0, ErrKeyNotFound
+	case errChecksumMismatchReply:
+		return 0, ErrChecksumMismatch
+	case errQuotaExceededReply:
+		return 0, ErrQuotaExceeded
+	case ackReply:
+		n, err := readUint32(c.conn)
+		check(err)
+		return n, nil
+	default:
+		panic(fmt.Errorf("Server error: %s", string(reply)))
+	}
+}
+
+// RenameUint is RenameBytes for uint values.
+func (c *Client) RenameUint(src, dst string) error {
+	return c.copyKey(renameCmd, TypeUint, src, dst)
+}
+
+// RenameUintIfNotExists is RenameBytesIfNotExists for uint values.
+func (c *Client) RenameUintIfNotExists(src, dst string) error {
+	return c.copyKey(renameIfNotExistsCmd, TypeUint, src, dst)
+}
+
+// CopyUint is CopyBytes for uint values.
+func (c *Client) CopyUint(src, dst string) error {
+	return c.copyKey(copyCmd, TypeUint, src, dst)
+}
+
+// Select switches the client to another namespace, which has its own keys
+// isolated from the other namespaces. The default namespace is
+// DefaultNamespace, and namespaces are created on first use. It returns
+// ErrQuotaExceeded if the namespace does not exist and the server holds
+// its maximum number of namespaces.
+func (c *Client) Select(namespace string) error {
+	try(sendMessage(c.conn, selectCmd))
+	try(sendBytes(c.conn, []byte(namespace)))
+	reply, err := readMessage(c.conn)
+	check(err)
+	switch reply {
+	case errQuotaExceededReply:
+		return ErrQuotaExceeded
+	case ackReply:
+		return nil
+	default:
+		panic(fmt.Errorf("Server error: %s", string(reply)))
+	}
+}
+
+// Flush deletes all the keys of the namespace of the client and returns
+// their number. Unlike FlushAll, it needs no admin token, as it only affects
+// the namespace of the client.
+func (c *Client) Flush() uint32 {
+	try(sendMessage(c.conn, flushCmd))
+	reply, err := readMessage(c.conn)
+	check(err)
+	switch reply {
+	case ackReply:
+		n, err := readUint32(c.conn)
+		check(err)
+		return n
+	default:
+		panic(fmt.Errorf("Server error: %s", string(reply)))
+	}
+}
+
+func (c *Client) delKeys(prefix, match string) uint32 {
+	try(sendMessage(c.conn, delKeysCmd))
+	try(sendBytes(c.conn, []byte(prefix)))
+	try(sendBytes(c.conn, []byte(match)))
+	reply, err := readMessage(c.conn)
+	check(err)
+	switch reply {
+	case ackReply:
+		n, err := readUint32(c.conn)
+		check(err)
+		return n
+	default:
+		panic(fmt.Errorf("Server error: %s", string(reply)))
+	}
+}
+
+// DelPrefix deletes all the values of the keys starting with prefix and
+// returns the number of keys deleted.
+func (c *Client) DelPrefix(prefix string) uint32 {
+	return c.delKeys(prefix, "")
+}
+
+// DelPattern deletes all the values of the keys matching the glob pattern,
+// see ScanOptions.Match, and returns the number of keys deleted.
+func (c *Client) DelPattern(pattern string) uint32 {
+	return c.delKeys("", pattern)
+}
+
+// FlushAll deletes all the keys of the server and returns their number. It
+// requires the admin token of the server and returns ErrPermissionDenied
+// otherwise.
+func (c *Client) FlushAll(token string) (uint32, error) {
+	try(sendMessage(c.conn, flushAllCmd))
+	try(sendBytes(c.conn, []byte(token)))
+	reply, err := readMessage(c.conn)
+	check(err)
+	switch reply {
+	case errPermissionDeniedReply:
+		return 0, ErrPermissionDenied
+	case ackReply:
+		n, err := readUint32(c.conn)
+		check(err)
+		return n, nil
+	default:
+		panic(fmt.Errorf("Server error: %s", string(reply)))
+	}
+}
+
+// SetBytesChecked sets the byte value of key after verifying on the server
+// that data matches crc, as computed by CRC32C. It returns
+// ErrChecksumMismatch otherwise, leaving the value untouched.
+func (c *Client) SetBytesChecked(key string, data []byte, crc uint32) error {
+	try(sendMessage(c.conn, setBytesCheckedCmd))
+	try(sendBytes(c.conn, []byte(key)))
+	try(sendUint32(c.conn, crc))
+	try(sendBytes(c.conn, data))
+	reply, err := readMessage(c.conn)
+	check(err)
+	switch reply {
+	case errChecksumMismatchReply:
+		return ErrChecksumMismatch
+	case errQuotaExceededReply:
+		return ErrQuotaExceeded
+	case ackReply:
+		return nil
+	default:
+		panic(fmt.Errorf("Server error: %s", string(reply)))
+	}
+}
+
+// Checksum returns the CRC32C of the byte range [start, end] of key,
+// computed on the server. Like GetBytesRange, the range is truncated to
+// the size of the value.
+func (c *Client) Checksum(key string, start, end uint32) (uint32, error) {
+	try(sendMessage(c.conn, checksumCmd))
+	try(sendBytes(c.conn, []byte(key)))
+	try(sendUint32(c.conn, start))
+	try(sendUint32(c.conn, end))
+	reply, err := readMessage(c.conn)
+	check(err)
+	switch reply {
+	case errNoKeyReply:
+		return 0, ErrKeyNotFound
+	case errChecksumMismatchReply:
+		return 0, ErrChecksumMismatch
+	case ackReply:
+		crc, err := readUint32(c.conn)
+		check(err)
+		return crc, nil
+	default:
+		panic(fmt.Errorf("Server error: %s", string(reply)))
+	}
+}
+
+// GetBytesVersion returns the byte value of key along with the version of
+// the key. Every write to one of the values of a key gives it a greater
+// version.
+func (c *Client) GetBytesVersion(key string) ([]byte, uint64, error) {
+	try(sendMessage(c.conn, getBytesVersionCmd))
+	try(sendBytes(c.conn, []byte(key)))
+	reply, err := readMessage(c.conn)
+	check(err)
+	switch reply {
+	case errNoKeyReply:
+		return nil, 0, ErrKeyNotFound
+	case errChecksumMismatchReply:
+		return nil, 0, ErrChecksumMismatch
+	case ackReply:
+		version, err := readUint64(c.conn)
+		check(err)
+		data, err := readBytes(c.conn)
+		check(err)
+		return data, version, nil
+	default:
+		panic(fmt.Errorf("Server error: %s", string(reply)))
+	}
+}
+
+// GetUintVersion returns the uint value of key along with the version of
+// the key.
+func (c *Client) GetUintVersion(key string) (uint32, uint64, error) {
+	try(sendMessage(c.conn, getUintVersionCmd))
+	try(sendBytes(c.conn, []byte(key)))
+	reply, err := readMessage(c.conn)
+	check(err)
+	switch reply {
+	case errNoKeyReply:
+		return 0, 0, ErrKeyNotFound
+	case ackReply:
+		version, err := readUint64(c.conn)
+		check(err)
+		val, err := readUint32(c.conn)
+		check(err)
+		return val, version, nil
+	default:
+		panic(fmt.Errorf("Server error: %s", string(reply)))
+	}
+}
+
+func (c *Client) readVersionReply() (uint64, error) {
+	reply, err := readMessage(c.conn)
+	check(err)
+	switch reply {
+	case errVersionConflictReply:
+		return 0, ErrVersionConflict
+	case errQuotaExceededReply:
+		return 0, ErrQuotaExceeded
+	case ackReply:
+		version, err := readUint64(c.conn)
+		check(err)
+		return version, nil
+	default:
+		panic(fmt.Errorf("Server error: %s", string(reply)))
+	}
+}
+
+// SetBytesIfVersion sets the byte value of key if the key is at version,
+// 0 meaning the key must not exist, and returns the new version. It returns
+// ErrVersionConflict otherwise.
+func (c *Client) SetBytesIfVersion(key string, data []byte, version uint64) (uint64, error) {
+	try(sendMessage(c.conn, setBytesIfVersionCmd))
+	try(sendBytes(c.conn, []byte(key)))
+	try(sendUint64(c.conn, version))
+	try(sendBytes(c.conn, data))
+	return c.readVersionReply()
+}
+
+// SetBytesRangeIfVersion is SetBytesRange if the key is at version, see
+// SetBytesIfVersion.
+func (c *Client) SetBytesRangeIfVersion(key string, start uint32, data []byte, version uint64) (uint64, error) {
+	try(sendMessage(c.conn, setBytesRangeIfVersionCmd))
+	try(sendBytes(c.conn, []byte(key)))
+	try(sendUint64(c.conn, version))
+	try(sendUint32(c.conn, start))
+	try(sendBytes(c.conn, data))
+	return c.readVersionReply()
+}
+
+// DelIfVersion deletes all the values of key if the key is at version. It
+// returns ErrVersionConflict otherwise.
+func (c *Client) DelIfVersion(key string, version uint64) error {
+	try(sendMessage(c.conn, delIfVersionCmd))
+	try(sendBytes(c.conn, []byte(key)))
+	try(sendUint64(c.conn, version))
+	reply, err := readMessage(c.conn)
+	check(err)
+	switch reply {
+	case errNoKeyReply:
+		return ErrKeyNotFound
+	case errVersionConflictReply:
+		return ErrVersionConflict
+	case ackReply:
+		return nil
+	default:
+		panic(fmt.Errorf("Server error: %s", string(reply)))
+	}
+}
+
+func (c *Client) lock(key string, ttl time.Duration, block bool, timeout time.Duration) (uint64, error) {
+	try(sendMessage(c.conn, lockCmd))
+	try(sendBytes(c.conn, []byte(key)))
+	try(sendInt64(c.conn, int64(ttl)))
+	try(sendBool(c.conn, block))
+	try(sendInt64(c.conn, int64(timeout)))
+	reply, err := readMessage(c.conn)
+	check(err)
+	switch reply {
+	case errLockedReply:
+		return 0, ErrLocked
+	case errTimeoutReply:
+		return 0, ErrTimeout
+	case ackReply:
+		token, err := readUint64(c.conn)
+		check(err)
+		return token, nil
+	default:
+		panic(fmt.Errorf("Server error: %s", string(reply)))
+	}
+}
+
+// Lock takes the lock on key for ttl and returns its fencing token, or
+// returns ErrLocked if someone else holds it. Locks are independent from
+// the values of the key.
+func (c *Client) Lock(key string, ttl time.Duration) (uint64, error) {
+	return c.lock(key, ttl, false, 0)
+}
+
+// LockWait takes the lock on key for ttl like Lock, waiting for it to be
+// released or to expire. It returns ErrTimeout once timeout expires, a zero
+// timeout waits forever.
+func (c *Client) LockWait(key string, ttl, timeout time.Duration) (uint64, error) {
+	return c.lock(key, ttl, true, timeout)
+}
+
+// Unlock releases the lock on key held with token.
+func (c *Client) Unlock(key string, token uint64) error {
+	try(sendMessage(c.conn, unlockCmd))
+	try(sendBytes(c.conn, []byte(key)))
+	try(sendUint64(c.conn, token))
+	reply, err := readMessage(c.conn)
+	check(err)
+	switch reply {
+	case errLockLostReply:
+		return ErrLockLost
+	case ackReply:
+		return nil
+	default:
+		panic(fmt.Errorf("Server error: %s", string(reply)))
+	}
+}
+
+// RefreshLock extends to ttl the lease of the lock on key held with token.
+// It returns ErrLockLost once the lease expired.
+func (c *Client) RefreshLock(key string, token uint64, ttl time.Duration) error {
+	try(sendMessage(c.conn, refreshLockCmd))
+	try(sendBytes(c.conn, []byte(key)))
+	try(sendUint64(c.conn, token))
+	try(sendInt64(c.conn, int64(ttl)))
+	reply, err := readMessage(c.conn)
+	check(err)
+	switch reply {
+	case errLockLostReply:
+		return ErrLockLost
+	case ackReply:
+		return nil
+	default:
+		panic(fmt.Errorf("Server error: %s", string(reply)))
+	}
+}
+
+// ScanOptions filters the keys returned by Scan
+type ScanOptions struct {
+	// Prefix selects keys starting with this prefix
+	Prefix string
+	// Match selects keys matching this glob pattern
+	Match string
+	// Type selects keys holding a value of one of these types
+	Type ValueType
+	// Count is the maximum number of keys returned by a single call, which
+	// may only be exceeded by keys sharing a hash
+	Count int
+}
+
+func (o *ScanOptions) normalize() {
+	if o.Type == 0 {
+		o.Type = TypeAny
+	}
+	if o.Count == 0 {
+		o.Count = 100
+	}
+}
+
+// ScanEntry is a key returned by Scan
+type ScanEntry struct {
+	Key  string
+	Type ValueType
+}
+
+// Scan iterates over the keys of the server. Start with a zero cursor and
+// pass the returned cursor to the next call, until it returns a zero
+// cursor. Keys set or deleted during the iteration may or may not be
+// returned, the other keys are returned, even if the returned keys are
+// deleted in the meantime.
+func (c *Client) Scan(cursor uint64, opt *ScanOptions) ([]ScanEntry, uint64) {
+	var o ScanOptions
+	if opt != nil {
+		o = *opt
+	}
+	o.normalize()
+	opt = &o
+	try(sendMessage(c.conn, scanCmd))
+	try(sendUint64(c.conn, cursor))
+	try(sendBytes(c.conn, []byte(opt.Prefix)))
+	try(sendBytes(c.conn, []byte(opt.Match)))
+	try(sendUint32(c.conn, uint32(opt.Type)))
+	try(sendUint32(c.conn, uint32(opt.Count)))
+	reply, err := readMessage(c.conn)
+	check(err)
+	switch reply {
+	case ackReply:
+		next, err := readUint64(c.conn)
+		check(err)
+		n, err := readUint32(c.conn)
+		check(err)
+		entries := make([]ScanEntry, n, n)
+		for i := range entries {
+			entries[i].Key, err = readString(c.conn)
+			check(err)
+			typ, err := readUint32(c.conn)
+			check(err)
+			entries[i].Type = ValueType(typ)
+		}
+		return entries, next
+	default:
+		panic(fmt.Errorf("Server error: %s", string(reply)))
+	}
+}
+
+// Info returns the state of the server.
+func (c *Client) Info() *Info {
+	try(sendMessage(c.conn, infoCmd))
+	reply, err := readMessage(c.conn)
+	check(err)
+	switch reply {
+	case ackReply:
+		data, err := readBytes(c.conn)
+		check(err)
+		info := &Info{}
+		check(json.Unmarshal(data, info))
+		return info
+	default:
+		panic(fmt.Errorf("Server error: %s", string(reply)))
+	}
+}
+
+// SlowLog returns the commands recorded in the server slow log, most
+// recent first.
+func (c *Client) SlowLog() []SlowLogEntry {
+	try(sendMessage(c.conn, slowLogGetCmd))
+	reply, err := readMessage(c.conn)
+	check(err)
+	switch reply {
+	case ackReply:
+		data, err := readBytes(c.conn)
+		check(err)
+		var entries []SlowLogEntry
+		check(json.Unmarshal(data, &entries))
+		return entries
+	default:
+		panic(fmt.Errorf("Server error: %s", string(reply)))
+	}
+}
+
+// ResetSlowLog clears the server slow log.
+func (c *Client) ResetSlowLog() {
+	try(sendMessage(c.conn, slowLogResetCmd))
+	reply, err := readMessage(c.conn)
+	check(err)
+	switch reply {
+	case ackReply:
+		return
+	default:
+		panic(fmt.Errorf("Server error: %s", string(reply)))
+	}
+}
+
+// openStream opens a dedicated connection for a streaming command, which is
+// read with readStream.
+func (c *Client) openStream(cmd Message, args func(conn net.Conn) error) (net.Conn, error) {
+	conn, err := net.Dial("tcp", c.addr)
+	if err != nil {
+		return nil, err
+	}
+	try(sendMessage(conn, cmd))
+	try(args(conn))
+	reply, err := readMessage(conn)
+	check(err)
+	if reply != ackReply {
+		panic(fmt.Errorf("Server error: %s", string(reply)))
+	}
+	return conn, nil
+}
+
+// readStream passes the payloads read on a stream connection to deliver,
+// until the stream ends, ctx is done or deliver returns false, and then
+// closes the connection
+func readStream(ctx context.Context, conn net.Conn, deliver func(data []byte) bool) {
+	ended := make(chan struct{})
+	defer close(ended)
+	go func() {
+		// closing the connection unblocks the read when ctx is done
+		select {
+		case <-ctx.Done():
+		case <-ended:
+		}
+		conn.Close()
+	}()
+	for {
+		data, err := readBytes(conn)
+		if err != nil || !deliver(data) {
+			return
+		}
+	}
+}
+
+// Monitor streams the commands processed by the server on a dedicated
+// connection, until ctx is done or the server stops. Events are dropped
+// if the reader does not keep up. An event which cannot be decoded ends the
+// stream with an event holding the error in Err.
+func (c *Client) Monitor(ctx context.Context) (<-chan MonitorEvent, error) {
+	conn, err := c.openStream(monitorCmd, func(net.Conn) error { return nil })
+	if err != nil {
+		return nil, err
+	}
+
+	events := make(chan MonitorEvent)
+	go func() {
+		defer close(events)
+		readStream(ctx, conn, func(data []byte) bool {
+			var event MonitorEvent
+			event.Err = json.Unmarshal(data, &event)
+			select {
+			case events <- event:
+				return event.Err == nil
+			case <-ctx.Done():
+				return false
+			}
+		})
+	}()
+	return events, nil
+}
+
+// Subscribe streams the events published on the channels selected by opt
+// on a dedicated connection, until ctx is done or the server stops. Events
+// are dropped if the reader does not keep up. An event which cannot be
+// decoded ends the stream with an event holding the error in Err.
+func (c *Client) Subscribe(ctx context.Context, opt *SubscribeOptions) (<-chan Event, error) {
+	conn, err := c.openStream(subscribeCmd, func(conn net.Conn) error {
+		if err := sendStrings(conn, opt.Channels); err != nil {
+			return err
+		}
+		return sendStrings(conn, opt.Patterns)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	events := make(chan Event)
+	go func() {
+		defer close(events)
+		readStream(ctx, conn, func(data []byte) bool {
+			var event Event
+			event.Err = json.Unmarshal(data, &event)
+			select {
+			case events <- event:
+				return event.Err == nil
+			case <-ctx.Done():
+				return false
+			}
+		})
+	}()
+	return events, nil
+}
+
+// Publish sends data on channel and returns the number of subscriptions
+// which received it.
+func (c *Client) Publish(channel string, data []byte) (uint32, error) {
+	try(sendMessage(c.conn, publishCmd))
+	try(sendBytes(c.conn, []byte(channel)))
+	try(sendBytes(c.conn, data))
+	reply, err := readMessage(c.conn)
+	check(err)
+	switch reply {
+	case errReservedReply:
+		return 0, ErrReservedChannel
+	case ackReply:
+		n, err := readUint32(c.conn)
+		check(err)
+		return n, nil
+	default:
+		panic(fmt.Errorf("Server error: %s", string(reply)))
+	}
+}
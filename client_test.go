@@ -2,8 +2,12 @@ package kvdroid_test
 
 import (
 	"bytes"
+	"context"
+	"fmt"
 	"io"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/JCapul/kvdroid"
 	"github.com/JCapul/kvdroid/util"
@@ -291,6 +295,29 @@ func TestTruncateBytes(t *testing.T) {
 	util.Equals(t, []byte("012"), recv, "received data does not match sent data")
 }
 
+func TestAppendBytes(t *testing.T) {
+	server, client := initClientServer()
+	defer server.Shutdown()
+	defer client.Close()
+
+	// append to a missing key
+	n, err := client.AppendBytes("foo", []byte("012"))
+	util.Ok(t, err)
+	util.Equals(t, uint32(3), n, "wrong value length")
+
+	n, err = client.AppendBytes("foo", []byte("3456"))
+	util.Ok(t, err)
+	util.Equals(t, uint32(7), n, "wrong value length")
+
+	offset, err := client.AppendBytesReturnOffset("foo", []byte("789"))
+	util.Ok(t, err)
+	util.Equals(t, uint32(7), offset, "wrong append offset")
+
+	recv, err := client.GetBytes("foo")
+	util.Ok(t, err)
+	util.Equals(t, []byte("0123456789"), recv, "received data does not match sent data")
+}
+
 func TestSetGetDelUint(t *testing.T) {
 	server, client := initClientServer()
 	defer server.Shutdown()
@@ -330,3 +357,1039 @@ func TestSetUintIfMax(t *testing.T) {
 	util.Ok(t, err)
 	util.Equals(t, uint32(100), recv, "values are different")
 }
+
+func TestAddUint(t *testing.T) {
+	server, client := initClientServer()
+	defer server.Shutdown()
+	defer client.Close()
+
+	// missing key starts at 0
+	recv, err := client.IncrUint("foo")
+	util.Ok(t, err)
+	util.Equals(t, uint32(1), recv, "values are different")
+
+	recv, _ = client.AddUint("foo", uint32(10))
+	util.Equals(t, uint32(11), recv, "values are different")
+
+	recv, _ = client.DecrUint("foo")
+	util.Equals(t, uint32(10), recv, "values are different")
+
+	recv, err = client.GetUint("foo")
+	util.Ok(t, err)
+	util.Equals(t, uint32(10), recv, "values are different")
+}
+
+func TestSetUintIfMin(t *testing.T) {
+	server, client := initClientServer()
+	defer server.Shutdown()
+	defer client.Close()
+
+	client.SetUintIfMin("foo", uint32(4))
+	recv, err := client.GetUint("foo")
+	util.Ok(t, err)
+	util.Equals(t, uint32(4), recv, "values are different")
+
+	// set higher value -> no op
+	client.SetUintIfMin("foo", uint32(100))
+	recv, err = client.GetUint("foo")
+	util.Ok(t, err)
+	util.Equals(t, uint32(4), recv, "values are different")
+
+	// set lower value
+	client.SetUintIfMin("foo", uint32(2))
+	recv, err = client.GetUint("foo")
+	util.Ok(t, err)
+	util.Equals(t, uint32(2), recv, "values are different")
+}
+
+func TestCompareAndSwapUint(t *testing.T) {
+	server, client := initClientServer()
+	defer server.Shutdown()
+	defer client.Close()
+
+	_, err := client.CompareAndSwapUint("foo", uint32(0), uint32(1))
+	util.Equals(t, kvdroid.ErrKeyNotFound, err, "should raise KeyNotFound error")
+
+	client.SetUint("foo", uint32(4))
+	swapped, err := client.CompareAndSwapUint("foo", uint32(3), uint32(5))
+	util.Ok(t, err)
+	util.Assert(t, !swapped, "swap should fail on value mismatch")
+
+	swapped, err = client.CompareAndSwapUint("foo", uint32(4), uint32(5))
+	util.Ok(t, err)
+	util.Assert(t, swapped, "swap should succeed on value match")
+
+	recv, err := client.GetUint("foo")
+	util.Ok(t, err)
+	util.Equals(t, uint32(5), recv, "values are different")
+}
+
+func TestGetAndSetUint(t *testing.T) {
+	server, client := initClientServer()
+	defer server.Shutdown()
+	defer client.Close()
+
+	_, err := client.GetAndSetUint("foo", uint32(4))
+	util.Equals(t, kvdroid.ErrKeyNotFound, err, "should raise KeyNotFound error")
+
+	old, err := client.GetAndSetUint("foo", uint32(7))
+	util.Ok(t, err)
+	util.Equals(t, uint32(4), old, "values are different")
+
+	recv, err := client.GetUint("foo")
+	util.Ok(t, err)
+	util.Equals(t, uint32(7), recv, "values are different")
+}
+
+func TestSetGetDelUint64(t *testing.T) {
+	server, client := initClientServer()
+	defer server.Shutdown()
+	defer client.Close()
+
+	big := uint64(1) << 40
+	client.SetUint64("foo", big)
+	recv, err := client.GetUint64("foo")
+	util.Ok(t, err)
+	util.Equals(t, big, recv, "values are different")
+
+	// set lower value -> no op
+	client.SetUint64IfMax("foo", uint64(2))
+	recv, err = client.GetUint64("foo")
+	util.Ok(t, err)
+	util.Equals(t, big, recv, "values are different")
+
+	recv, _ = client.AddUint64("foo", big)
+	util.Equals(t, 2*big, recv, "values are different")
+
+	// uint64 and uint keys do not collide
+	_, err = client.GetUint("foo")
+	util.Equals(t, kvdroid.ErrKeyNotFound, err, "key should not exist")
+
+	err = client.DelUint64("foo")
+	util.Ok(t, err)
+
+	_, err = client.GetUint64("foo")
+	util.Equals(t, kvdroid.ErrKeyNotFound, err, "key should not exist")
+}
+
+func TestSetGetDelInt64(t *testing.T) {
+	server, client := initClientServer()
+	defer server.Shutdown()
+	defer client.Close()
+
+	client.SetInt64("foo", int64(-5))
+	recv, err := client.GetInt64("foo")
+	util.Ok(t, err)
+	util.Equals(t, int64(-5), recv, "values are different")
+
+	// set lower value -> no op
+	client.SetInt64IfMax("foo", int64(-10))
+	recv, err = client.GetInt64("foo")
+	util.Ok(t, err)
+	util.Equals(t, int64(-5), recv, "values are different")
+
+	client.SetInt64IfMax("foo", int64(3))
+	recv, err = client.GetInt64("foo")
+	util.Ok(t, err)
+	util.Equals(t, int64(3), recv, "values are different")
+
+	recv, _ = client.AddInt64("foo", int64(-7))
+	util.Equals(t, int64(-4), recv, "values are different")
+
+	err = client.DelInt64("foo")
+	util.Ok(t, err)
+
+	_, err = client.GetInt64("foo")
+	util.Equals(t, kvdroid.ErrKeyNotFound, err, "key should not exist")
+}
+
+func TestKeyMetadata(t *testing.T) {
+	server, client := initClientServer()
+	defer server.Shutdown()
+	defer client.Close()
+
+	util.Assert(t, !client.Exists("foo"), "key should not exist")
+	_, err := client.Type("foo")
+	util.Equals(t, kvdroid.ErrKeyNotFound, err, "should raise KeyNotFound error")
+	_, err = client.SizeBytes("foo")
+	util.Equals(t, kvdroid.ErrKeyNotFound, err, "should raise KeyNotFound error")
+	_, err = client.Stat("foo")
+	util.Equals(t, kvdroid.ErrKeyNotFound, err, "should raise KeyNotFound error")
+
+	before := time.Now()
+	client.SetBytes("foo", []byte("0123456789"))
+	client.SetUint("foo", uint32(3))
+	util.Assert(t, client.Exists("foo"), "key should exist")
+
+	typ, err := client.Type("foo")
+	util.Ok(t, err)
+	util.Equals(t, kvdroid.TypeBytes|kvdroid.TypeUint, typ, "wrong key type")
+
+	size, err := client.SizeBytes("foo")
+	util.Ok(t, err)
+	util.Equals(t, uint32(10), size, "wrong value size")
+
+	stat, err := client.Stat("foo")
+	util.Ok(t, err)
+	util.Equals(t, typ, stat.Type, "wrong key type")
+	util.Equals(t, size, stat.Size, "wrong value size")
+	util.Assert(t, !stat.ModTime.Before(before), "modification time is too old")
+
+	err = client.DelBytes("foo")
+	util.Ok(t, err)
+	typ, err = client.Type("foo")
+	util.Ok(t, err)
+	util.Equals(t, kvdroid.TypeUint, typ, "wrong key type")
+
+	err = client.DelUint("foo")
+	util.Ok(t, err)
+	util.Assert(t, !client.Exists("foo"), "key should not exist")
+	_, err = client.Stat("foo")
+	util.Equals(t, kvdroid.ErrKeyNotFound, err, "should raise KeyNotFound error")
+}
+
+func TestWaitUint(t *testing.T) {
+	server, client := initClientServer()
+	defer server.Shutdown()
+	defer client.Close()
+	producer := kvdroid.NewClient(server.Addr())
+	defer producer.Close()
+
+	_, err := client.WaitUintAtLeast("foo", uint32(3), 10*time.Millisecond)
+	util.Equals(t, kvdroid.ErrTimeout, err, "should raise Timeout error")
+
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < 5; i++ {
+			time.Sleep(time.Millisecond)
+			producer.IncrUint("foo")
+		}
+		done <- true
+	}()
+	val, err := client.WaitUintAtLeast("foo", uint32(3), 0)
+	util.Ok(t, err)
+	util.Assert(t, val >= 3, "value should be at least 3, got %d", val)
+	<-done
+
+	go func() {
+		time.Sleep(time.Millisecond)
+		producer.SetUint("foo", uint32(1))
+		done <- true
+	}()
+	val, err = client.WaitUintAtMost("foo", uint32(1), time.Second)
+	util.Ok(t, err)
+	util.Equals(t, uint32(1), val, "values are different")
+	<-done
+}
+
+func TestWaitExists(t *testing.T) {
+	server, client := initClientServer()
+	defer server.Shutdown()
+	defer client.Close()
+	producer := kvdroid.NewClient(server.Addr())
+	defer producer.Close()
+
+	err := client.WaitExists("foo", 10*time.Millisecond)
+	util.Equals(t, kvdroid.ErrTimeout, err, "should raise Timeout error")
+
+	done := make(chan bool)
+	go func() {
+		time.Sleep(time.Millisecond)
+		producer.SetBytes("foo", []byte("bar"))
+		done <- true
+	}()
+	err = client.WaitExists("foo", time.Second)
+	util.Ok(t, err)
+	<-done
+
+	// a client disconnecting while waiting forever
+	waiter := kvdroid.NewClient(server.Addr())
+	go func() {
+		defer func() { recover() }()
+		waiter.WaitExists("bar", 0)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	waiter.Close()
+	for i := 0; client.Info().ConnectedClients > 2; i++ {
+		util.Assert(t, i < 100, "the waiting connection should be closed")
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestCompression(t *testing.T) {
+	server := kvdroid.NewServer(&kvdroid.ServerOptions{Port: -1, CompressionThreshold: 1024})
+	go server.Start()
+	defer server.Shutdown()
+	client := kvdroid.NewClientWithOptions(server.Addr(), &kvdroid.ClientOptions{CompressionThreshold: 64})
+	defer client.Close()
+	plain := kvdroid.NewClient(server.Addr())
+	defer plain.Close()
+
+	data := bytes.Repeat([]byte("foobar"), 100000)
+	client.SetBytes("foo", data)
+	info := plain.Info()
+	util.Assert(t, info.BytesIn < uint64(len(data))/10, "payload should be compressed")
+	value, _ := client.GetBytes("foo")
+	util.Equals(t, data, value, "data should match")
+	value, _ = plain.GetBytes("foo")
+	util.Equals(t, data, value, "data should match")
+
+	client.SetBytesRange("foo", 3, data[:3000])
+	dst := make([]byte, 10)
+	n, _ := client.GetBytesRangeInto("foo", 3, 12, dst)
+	util.Equals(t, uint32(10), n, "size should match")
+	util.Equals(t, data[:10], dst, "data should match")
+	dst = make([]byte, len(data))
+	n, err := client.GetBytesInto("foo", dst)
+	util.Ok(t, err)
+	util.Equals(t, uint32(len(data)), n, "size should match")
+
+	// small payloads are not compressed
+	client.SetBytes("bar", []byte("bar"))
+	value, _ = plain.GetBytes("bar")
+	util.Equals(t, []byte("bar"), value, "data should match")
+}
+
+func TestStorageCompression(t *testing.T) {
+	server := kvdroid.NewServer(&kvdroid.ServerOptions{Port: -1, StorageCompressionThreshold: 1000, StorageBlockSize: 256})
+	go server.Start()
+	defer server.Shutdown()
+	client := kvdroid.NewClient(server.Addr())
+	defer client.Close()
+
+	data := bytes.Repeat([]byte("0123456789"), 200)
+	client.SetBytes("foo", data)
+	value, _ := client.GetBytes("foo")
+	util.Equals(t, data, value, "data should match")
+	info := client.Info()
+	util.Equals(t, int64(len(data)), info.CompressedBytes, "compressed bytes should match")
+	util.Assert(t, info.CompressionRatio() > 2, "compression ratio should be high")
+
+	// ranges over several blocks
+	value, _ = client.GetBytesRange("foo", 250, 1049)
+	util.Equals(t, data[250:1050], value, "data should match")
+	client.SetBytesRange("foo", 500, []byte("abcdefghij"))
+	copy(data[500:], "abcdefghij")
+	client.SetBytesRange("foo", 1990, bytes.Repeat([]byte("x"), 20))
+	data = append(data[:1990], bytes.Repeat([]byte("x"), 20)...)
+	value, _ = client.GetBytes("foo")
+	util.Equals(t, data, value, "data should match")
+
+	// extension beyond the end with zeros
+	client.SetBytesRange("foo", 2600, []byte("end"))
+	data = append(data, make([]byte, 2600-len(data))...)
+	data = append(data, "end"...)
+	client.AppendBytes("foo", []byte("!"))
+	data = append(data, '!')
+	size, _ := client.SizeBytes("foo")
+	util.Equals(t, uint32(len(data)), size, "size should match")
+	value, _ = client.GetBytes("foo")
+	util.Equals(t, data, value, "data should match")
+	crc, _ := client.Checksum("foo", 100, 2000)
+	util.Equals(t, kvdroid.CRC32C(data[100:2001]), crc, "checksum should match")
+
+	util.Ok(t, client.TruncateBytes("foo", 300))
+	dst := make([]byte, 1000)
+	n, _ := client.GetBytesInto("foo", dst)
+	util.Equals(t, data[:300], dst[:n], "data should match")
+	info = client.Info()
+	util.Equals(t, int64(300), info.Bytes, "bytes should match")
+	util.Equals(t, int64(300), info.CompressedBytes, "compressed bytes should match")
+
+	// a corrupted block only fails the reads which overlap it
+	server.CorruptBytes("foo")
+	_, err := client.GetBytes("foo")
+	util.Equals(t, kvdroid.ErrChecksumMismatch, err, "should raise ChecksumMismatch error")
+	value, err = client.GetBytesRange("foo", 0, 255)
+	util.Ok(t, err)
+	util.Equals(t, data[:256], value, "data should match")
+
+	util.Ok(t, client.DelBytes("foo"))
+	info = client.Info()
+	util.Equals(t, int64(0), info.CompressedBytes, "compressed bytes should match")
+	util.Equals(t, int64(0), info.CompressedSize, "compressed size should match")
+}
+
+func TestUnlink(t *testing.T) {
+	server, client := initClientServer()
+	defer server.Shutdown()
+	defer client.Close()
+
+	for i := 0; i < 10; i++ {
+		client.SetBytes(fmt.Sprintf("chunk%d", i), []byte("foo"))
+	}
+	client.SetUint("chunk0", 1)
+	util.Equals(t, uint32(3), client.UnlinkBytes("chunk0", "chunk1", "chunk2", "missing"), "count should match")
+	_, err := client.GetBytes("chunk1")
+	util.Equals(t, kvdroid.ErrKeyNotFound, err, "should raise KeyNotFound error")
+	val, _ := client.GetUint("chunk0")
+	util.Equals(t, uint32(1), val, "uint value should remain")
+	util.Equals(t, uint32(1), client.UnlinkUint("chunk0", "chunk3"), "count should match")
+	util.Equals(t, false, client.Exists("chunk0"), "key should be deleted")
+	util.Equals(t, uint64(7), client.Info().Keys, "keys should match")
+
+	// the byte values are released in the background
+	for i := 0; i < 100 && client.Info().Bytes != 21; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	util.Equals(t, int64(21), client.Info().Bytes, "bytes should match")
+}
+
+func TestDelKeys(t *testing.T) {
+	server := kvdroid.NewServer(&kvdroid.ServerOptions{Port: -1, AdminToken: "secret"})
+	go server.Start()
+	defer server.Shutdown()
+	client := kvdroid.NewClient(server.Addr())
+	defer client.Close()
+
+	for i := 0; i < 10; i++ {
+		client.SetBytes(fmt.Sprintf("job1/chunk%d", i), []byte("foo"))
+		client.SetUint(fmt.Sprintf("job2/chunk%d", i), 1)
+	}
+	client.SetUint("job1/chunk0", 1)
+	util.Equals(t, uint32(10), client.DelPrefix("job1/"), "count should match")
+	util.Equals(t, false, client.Exists("job1/chunk0"), "key should be deleted")
+	util.Equals(t, uint32(1), client.DelPattern("*/chunk1"), "count should match")
+	util.Equals(t, uint32(0), client.DelPattern("*/chunk1"), "count should match")
+
+	_, err := client.FlushAll("")
+	util.Equals(t, kvdroid.ErrPermissionDenied, err, "should raise PermissionDenied error")
+	n, err := client.FlushAll("secret")
+	util.Ok(t, err)
+	util.Equals(t, uint32(9), n, "count should match")
+	util.Equals(t, uint64(0), client.Info().Keys, "keys should match")
+}
+
+func TestNamespace(t *testing.T) {
+	server, client := initClientServer()
+	defer server.Shutdown()
+	defer client.Close()
+	other := kvdroid.NewClientWithOptions(server.Addr(), &kvdroid.ClientOptions{Namespace: "job2"})
+	defer other.Close()
+
+	client.SetBytes("foo", []byte("foo"))
+	client.SetUint("bar", 1)
+	_, err := other.GetBytes("foo")
+	util.Equals(t, kvdroid.ErrKeyNotFound, err, "namespaces should be isolated")
+	other.SetBytes("foo", []byte("job2"))
+	data, _ := client.GetBytes("foo")
+	util.Equals(t, []byte("foo"), data, "namespaces should be isolated")
+	util.Equals(t, 1, len(scanAll(other, &kvdroid.ScanOptions{})), "scan should be isolated")
+
+	info := client.Info()
+	util.Equals(t, uint64(3), info.Keys, "keys should match")
+	util.Equals(t, kvdroid.NamespaceInfo{Keys: 2, Bytes: 3}, info.Namespaces[kvdroid.DefaultNamespace], "default namespace info should match")
+	util.Equals(t, kvdroid.NamespaceInfo{Keys: 1, Bytes: 4}, info.Namespaces["job2"], "job2 namespace info should match")
+
+	// flushing a namespace leaves the others untouched
+	util.Equals(t, uint32(1), other.Flush(), "count should match")
+	util.Equals(t, true, client.Exists("foo"), "key should remain")
+	util.Ok(t, client.Select("job2"))
+	util.Equals(t, false, client.Exists("foo"), "key should be deleted")
+	util.Ok(t, client.Select(kvdroid.DefaultNamespace))
+	util.Equals(t, true, client.Exists("foo"), "key should remain")
+}
+
+func TestMaxNamespaces(t *testing.T) {
+	server := kvdroid.NewServer(&kvdroid.ServerOptions{Port: -1, MaxNamespaces: 2})
+	go server.Start()
+	defer server.Shutdown()
+	client := kvdroid.NewClient(server.Addr())
+	defer client.Close()
+
+	util.Ok(t, client.Select("job1"))
+	util.Equals(t, kvdroid.ErrQuotaExceeded, client.Select("job2"), "should raise QuotaExceeded error")
+	// the connection stays in its namespace
+	client.SetUint("foo", 1)
+	util.Ok(t, client.Select(kvdroid.DefaultNamespace))
+	util.Equals(t, false, client.Exists("foo"), "key should be in job1")
+	util.Ok(t, client.Select("job1"))
+	util.Equals(t, true, client.Exists("foo"), "key should be in job1")
+}
+
+func TestChecksum(t *testing.T) {
+	server, client := initClientServer()
+	defer server.Shutdown()
+	defer client.Close()
+
+	data := []byte("foobar")
+	err := client.SetBytesChecked("foo", data, kvdroid.CRC32C(data)+1)
+	util.Equals(t, kvdroid.ErrChecksumMismatch, err, "should raise ChecksumMismatch error")
+	_, err = client.GetBytes("foo")
+	util.Equals(t, kvdroid.ErrKeyNotFound, err, "value should not be set")
+	util.Ok(t, client.SetBytesChecked("foo", data, kvdroid.CRC32C(data)))
+
+	crc, err := client.Checksum("foo", 0, 5)
+	util.Ok(t, err)
+	util.Equals(t, kvdroid.CRC32C(data), crc, "checksum should match")
+	crc, _ = client.Checksum("foo", 3, 100)
+	util.Equals(t, kvdroid.CRC32C([]byte("bar")), crc, "checksum should match")
+	crc, _ = client.Checksum("foo", 10, 100)
+	util.Equals(t, kvdroid.CRC32C(nil), crc, "checksum should match")
+	_, err = client.Checksum("bar", 0, 5)
+	util.Equals(t, kvdroid.ErrKeyNotFound, err, "should raise KeyNotFound error")
+
+	// stored values are checked on every read
+	server.CorruptBytes("foo")
+	_, err = client.GetBytes("foo")
+	util.Equals(t, kvdroid.ErrChecksumMismatch, err, "should raise ChecksumMismatch error")
+	_, err = client.GetBytesRange("foo", 3, 5)
+	util.Equals(t, kvdroid.ErrChecksumMismatch, err, "should raise ChecksumMismatch error")
+	util.Equals(t, kvdroid.ErrChecksumMismatch, client.CopyBytes("foo", "bar"), "should raise ChecksumMismatch error")
+	_, err = client.GetBytes("bar")
+	util.Equals(t, kvdroid.ErrKeyNotFound, err, "value should not be copied")
+	client.SetBytes("foo", data)
+	value, err := client.GetBytes("foo")
+	util.Ok(t, err)
+	util.Equals(t, data, value, "data should match")
+}
+
+func TestVersion(t *testing.T) {
+	server, client := initClientServer()
+	defer server.Shutdown()
+	defer client.Close()
+
+	_, err := client.SetBytesIfVersion("foo", []byte("foo"), 1)
+	util.Equals(t, kvdroid.ErrVersionConflict, err, "should raise VersionConflict error")
+	v1, err := client.SetBytesIfVersion("foo", []byte("foo"), 0)
+	util.Ok(t, err)
+	data, version, err := client.GetBytesVersion("foo")
+	util.Ok(t, err)
+	util.Equals(t, []byte("foo"), data, "data should match")
+	util.Equals(t, v1, version, "version should match")
+
+	_, err = client.SetBytesRangeIfVersion("foo", 3, []byte("bar"), 0)
+	util.Equals(t, kvdroid.ErrVersionConflict, err, "should raise VersionConflict error")
+	v2, err := client.SetBytesRangeIfVersion("foo", 3, []byte("bar"), v1)
+	util.Ok(t, err)
+	util.Assert(t, v2 > v1, "version should increase")
+	data, _ = client.GetBytes("foo")
+	util.Equals(t, []byte("foobar"), data, "data should match")
+
+	// every value of the key shares the version
+	client.SetUint("foo", 1)
+	_, v3, err := client.GetUintVersion("foo")
+	util.Ok(t, err)
+	util.Assert(t, v3 > v2, "version should increase")
+	util.Equals(t, kvdroid.ErrVersionConflict, client.DelIfVersion("foo", v2), "should raise VersionConflict error")
+	util.Ok(t, client.DelIfVersion("foo", v3))
+	exists := client.Exists("foo")
+	util.Equals(t, false, exists, "key should be deleted")
+	util.Equals(t, kvdroid.ErrKeyNotFound, client.DelIfVersion("foo", 0), "should raise KeyNotFound error")
+}
+
+func TestVersionConcurrent(t *testing.T) {
+	server, client := initClientServer()
+	defer server.Shutdown()
+	defer client.Close()
+
+	// the writers are connected beforehand so that they write together
+	writers := make([]*kvdroid.Client, 20)
+	for i := range writers {
+		writers[i] = kvdroid.NewClient(server.Addr())
+		defer writers[i].Close()
+	}
+	client.SetBytes("foo", []byte("foo"))
+	for round := 0; round < 50; round++ {
+		_, version, err := client.GetBytesVersion("foo")
+		util.Ok(t, err)
+		start := make(chan struct{})
+		wins := make(chan string, len(writers))
+		var wg sync.WaitGroup
+		for i, writer := range writers {
+			wg.Add(1)
+			go func(data string, writer *kvdroid.Client) {
+				defer wg.Done()
+				<-start
+				if _, err := writer.SetBytesIfVersion("foo", []byte(data), version); err == nil {
+					wins <- data
+				}
+			}(fmt.Sprintf("round%d/writer%d", round, i), writer)
+		}
+		close(start)
+		wg.Wait()
+		close(wins)
+		util.Equals(t, 1, len(wins), "exactly one writer should win")
+		data, _ := client.GetBytes("foo")
+		util.Equals(t, <-wins, string(data), "the winner should be written")
+	}
+}
+
+func TestLock(t *testing.T) {
+	server, client := initClientServer()
+	defer server.Shutdown()
+	defer client.Close()
+	other := kvdroid.NewClient(server.Addr())
+	defer other.Close()
+
+	token, err := client.Lock("foo", time.Minute)
+	util.Ok(t, err)
+	_, err = other.Lock("foo", time.Minute)
+	util.Equals(t, kvdroid.ErrLocked, err, "should raise Locked error")
+	_, err = other.LockWait("foo", time.Minute, 10*time.Millisecond)
+	util.Equals(t, kvdroid.ErrTimeout, err, "should raise Timeout error")
+
+	err = other.Unlock("foo", token+1)
+	util.Equals(t, kvdroid.ErrLockLost, err, "should raise LockLost error")
+	util.Ok(t, client.RefreshLock("foo", token, 20*time.Millisecond))
+
+	// the lease expires
+	token2, err := other.LockWait("foo", time.Minute, time.Second)
+	util.Ok(t, err)
+	util.Assert(t, token2 > token, "fencing tokens should increase")
+	err = client.RefreshLock("foo", token, time.Minute)
+	util.Equals(t, kvdroid.ErrLockLost, err, "should raise LockLost error")
+
+	// waiters are woken up by unlock
+	done := make(chan bool)
+	go func() {
+		time.Sleep(time.Millisecond)
+		other.Unlock("foo", token2)
+		done <- true
+	}()
+	_, err = client.LockWait("foo", time.Minute, 0)
+	util.Ok(t, err)
+	<-done
+
+	// an expired lease cannot be refreshed, even if nobody took the lock
+	token, err = client.Lock("bar", time.Millisecond)
+	util.Ok(t, err)
+	time.Sleep(10 * time.Millisecond)
+	err = client.RefreshLock("bar", token, time.Minute)
+	util.Equals(t, kvdroid.ErrLockLost, err, "should raise LockLost error")
+}
+
+func TestMutex(t *testing.T) {
+	server, client := initClientServer()
+	defer server.Shutdown()
+	defer client.Close()
+
+	mutex := kvdroid.NewMutex(client, "foo", time.Minute)
+	util.Ok(t, mutex.Lock(time.Second))
+	util.Assert(t, mutex.Token() > 0, "token should be set")
+	util.Ok(t, mutex.Refresh())
+	util.Ok(t, mutex.Unlock())
+	util.Equals(t, kvdroid.ErrLockLost, mutex.Unlock(), "should raise LockLost error")
+}
+
+func TestTx(t *testing.T) {
+	server, client := initClientServer()
+	defer server.Shutdown()
+	defer client.Close()
+	other := kvdroid.NewClient(server.Addr())
+	defer other.Close()
+
+	tx := client.Multi()
+	tx.AppendBytes("chunks", []byte("foo"))
+	tx.AddUint("chunks.count", 1)
+	tx.SetBytesRange("chunks", 1, []byte("a"))
+	tx.DelUint("missing")
+	tx.SetBytesChecked("checked", []byte("bar"), kvdroid.CRC32C([]byte("bar")))
+	tx.SetBytesChecked("corrupted", []byte("bar"), 0)
+	errs, err := tx.Exec()
+	util.Ok(t, err)
+	util.Equals(t, []error{nil, nil, nil, kvdroid.ErrKeyNotFound, nil, kvdroid.ErrChecksumMismatch}, errs, "errors should match")
+	util.Equals(t, true, client.Exists("checked"), "checked write should run")
+	util.Equals(t, false, client.Exists("corrupted"), "corrupted write should not run")
+	data, _ := client.GetBytes("chunks")
+	util.Equals(t, []byte("fao"), data, "data should match")
+	count, _ := client.GetUint("chunks.count")
+	util.Equals(t, uint32(1), count, "count should match")
+
+	// an unmodified watched key
+	tx.Watch("chunks", "other")
+	tx.SetUint("chunks.count", 2)
+	_, err = tx.Exec()
+	util.Ok(t, err)
+
+	// a modified watched key
+	tx.Watch("chunks.count", "other")
+	other.SetUint("other", 1)
+	tx.SetUint("chunks.count", 3)
+	_, err = tx.Exec()
+	util.Equals(t, kvdroid.ErrTxAborted, err, "should raise TxAborted error")
+	count, _ = client.GetUint("chunks.count")
+	util.Equals(t, uint32(2), count, "count should not be modified")
+
+	// a missing watched key created then deleted
+	tx.Watch("missing")
+	other.SetUint("missing", 1)
+	other.DelUint("missing")
+	tx.SetUint("chunks.count", 3)
+	_, err = tx.Exec()
+	util.Equals(t, kvdroid.ErrTxAborted, err, "should raise TxAborted error")
+}
+
+func TestTxInvalid(t *testing.T) {
+	server, client := initClientServer()
+	defer server.Shutdown()
+	defer client.Close()
+
+	// a command not allowed in transactions
+	tx := client.Multi()
+	tx.SetUint("count", 1)
+	tx.QueueRaw(kvdroid.SelectCmd, "other", nil)
+	_, err := tx.Exec()
+	util.Equals(t, kvdroid.ErrTxInvalid, err, "should raise TxInvalid error")
+
+	// a command missing its argument
+	tx.SetUint("count", 1)
+	tx.QueueRaw(kvdroid.SetUintCmd, "other", []byte{0, 1})
+	_, err = tx.Exec()
+	util.Equals(t, kvdroid.ErrTxInvalid, err, "should raise TxInvalid error")
+
+	// nothing ran and the server keeps serving the connection
+	_, err = client.GetUint("count")
+	util.Equals(t, kvdroid.ErrKeyNotFound, err, "should raise KeyNotFound error")
+	client.SetUint("count", 2)
+	count, err := client.GetUint("count")
+	util.Ok(t, err)
+	util.Equals(t, uint32(2), count, "wrong count")
+}
+
+func scanAll(client *kvdroid.Client, opt *kvdroid.ScanOptions) map[string]kvdroid.ValueType {
+	keys := make(map[string]kvdroid.ValueType)
+	cursor := uint64(0)
+	for {
+		var entries []kvdroid.ScanEntry
+		entries, cursor = client.Scan(cursor, opt)
+		for _, entry := range entries {
+			keys[entry.Key] = entry.Type
+		}
+		if cursor == 0 {
+			return keys
+		}
+	}
+}
+
+func TestScan(t *testing.T) {
+	server, client := initClientServer()
+	defer server.Shutdown()
+	defer client.Close()
+
+	for i := 0; i < 50; i++ {
+		client.SetBytes(fmt.Sprintf("job1/chunk/%d", i), []byte("data"))
+	}
+	client.SetUint("job1/count", uint32(50))
+	client.SetBytes("job2/chunk/0", []byte("data"))
+	client.SetUint("job2/chunk/0", uint32(1))
+
+	keys := scanAll(client, &kvdroid.ScanOptions{Count: 7})
+	util.Equals(t, 52, len(keys), "wrong number of keys")
+	util.Equals(t, kvdroid.TypeBytes|kvdroid.TypeUint, keys["job2/chunk/0"], "wrong key type")
+
+	keys = scanAll(client, &kvdroid.ScanOptions{Prefix: "job1/"})
+	util.Equals(t, 51, len(keys), "wrong number of keys")
+
+	keys = scanAll(client, &kvdroid.ScanOptions{Match: "*/chunk/1?"})
+	util.Equals(t, 10, len(keys), "wrong number of keys")
+
+	keys = scanAll(client, &kvdroid.ScanOptions{Type: kvdroid.TypeUint})
+	util.Equals(t, map[string]kvdroid.ValueType{
+		"job1/count":   kvdroid.TypeUint,
+		"job2/chunk/0": kvdroid.TypeUint,
+	}, keys, "wrong keys")
+}
+
+func TestScanDelete(t *testing.T) {
+	server, client := initClientServer()
+	defer server.Shutdown()
+	defer client.Close()
+
+	for i := 0; i < 50; i++ {
+		client.SetBytes(fmt.Sprintf("chunk%d", i), []byte("data"))
+	}
+	// deleting the keys as they are scanned skips none
+	opt := &kvdroid.ScanOptions{Count: 10}
+	cursor := uint64(0)
+	for {
+		var entries []kvdroid.ScanEntry
+		entries, cursor = client.Scan(cursor, opt)
+		for _, entry := range entries {
+			client.DelBytes(entry.Key)
+		}
+		if cursor == 0 {
+			break
+		}
+	}
+	util.Equals(t, 0, len(scanAll(client, &kvdroid.ScanOptions{})), "all keys should be deleted")
+	util.Equals(t, kvdroid.ScanOptions{Count: 10}, *opt, "options should not be modified")
+}
+
+func TestInfo(t *testing.T) {
+	server, client := initClientServer()
+	defer server.Shutdown()
+	defer client.Close()
+
+	client.SetBytes("foo", []byte("0123456789"))
+	client.SetBytes("bar", []byte("01234"))
+	client.SetUint("bar", uint32(3))
+	client.AppendBytes("bar", []byte("56789"))
+	client.TruncateBytes("foo", uint32(8))
+
+	info := client.Info()
+	util.Equals(t, uint64(2), info.Keys, "wrong number of keys")
+	util.Equals(t, int64(18), info.Bytes, "wrong number of bytes")
+	util.Equals(t, int64(1), info.ConnectedClients, "wrong number of clients")
+	util.Equals(t, uint64(2), info.Ops["SetBytes"], "wrong number of operations")
+	util.Equals(t, uint64(1), info.Ops["Info"], "wrong number of operations")
+	util.Assert(t, info.BytesIn > 0 && info.BytesOut > 0, "traffic should be counted")
+
+	keys := uint64(0)
+	for _, bucket := range info.Buckets {
+		keys += bucket.Keys
+	}
+	util.Equals(t, info.Keys, keys, "bucket keys should add up")
+}
+
+func TestMonitor(t *testing.T) {
+	server, client := initClientServer()
+	defer server.Shutdown()
+	defer client.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	events, err := client.Monitor(ctx)
+	util.Ok(t, err)
+
+	client.SetBytes("foo", []byte("0123456789"))
+	client.GetUint("bar")
+
+	event := <-events
+	util.Equals(t, "SetBytes", event.Command, "wrong command")
+	util.Equals(t, "foo", event.Key, "wrong key")
+	util.Equals(t, uint64(21), event.RequestBytes, "wrong request size")
+	event = <-events
+	util.Equals(t, "GetUint", event.Command, "wrong command")
+	util.Equals(t, "bar", event.Key, "wrong key")
+
+	cancel()
+	for range events {
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	server, client := initClientServer()
+	defer server.Shutdown()
+	defer client.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	events, err := client.Subscribe(ctx, &kvdroid.SubscribeOptions{
+		Channels: []string{"news"},
+		Patterns: []string{kvdroid.KeyspaceChannel("job/*")},
+	})
+	util.Ok(t, err)
+
+	client.SetBytes("job/chunk", []byte("0123456789"))
+	client.SetBytes("other", []byte("0123456789"))
+	client.SetBytesRange("job/chunk", uint32(2), []byte("ab"))
+	client.TruncateBytes("job/chunk", uint32(4))
+	client.DelBytes("job/missing")
+	client.IncrUint("job/count")
+	// writes which change nothing notify nothing
+	client.TruncateBytes("job/chunk", uint32(10))
+	client.SetUintIfMax("job/count", 0)
+	client.SetUintIfMin("job/count", 5)
+	client.CompareAndSwapUint("job/count", 7, 8)
+	client.DelBytes("job/chunk")
+	// a flush notifies the deletion of each key
+	client.Flush()
+
+	n, err := client.Publish("news", []byte("hello"))
+	util.Ok(t, err)
+	util.Equals(t, uint32(1), n, "wrong number of receivers")
+	n, err = client.Publish("weather", []byte("sunny"))
+	util.Ok(t, err)
+	util.Equals(t, uint32(0), n, "wrong number of receivers")
+	_, err = client.Publish(kvdroid.KeyspaceChannel("job/chunk"), nil)
+	util.Equals(t, kvdroid.ErrReservedChannel, err, "should raise ReservedChannel error")
+
+	for _, exp := range []kvdroid.Event{
+		{Kind: kvdroid.EventSet, Channel: kvdroid.KeyspaceChannel("job/chunk"), Key: "job/chunk"},
+		{Kind: kvdroid.EventSetRange, Channel: kvdroid.KeyspaceChannel("job/chunk"), Key: "job/chunk"},
+		{Kind: kvdroid.EventTruncate, Channel: kvdroid.KeyspaceChannel("job/chunk"), Key: "job/chunk"},
+		{Kind: kvdroid.EventSet, Channel: kvdroid.KeyspaceChannel("job/count"), Key: "job/count"},
+		{Kind: kvdroid.EventDel, Channel: kvdroid.KeyspaceChannel("job/chunk"), Key: "job/chunk"},
+		{Kind: kvdroid.EventDel, Channel: kvdroid.KeyspaceChannel("job/count"), Key: "job/count"},
+		{Kind: kvdroid.EventPublish, Channel: "news", Data: []byte("hello")},
+	} {
+		util.Equals(t, exp, <-events, "wrong event")
+	}
+
+	cancel()
+	for range events {
+	}
+}
+
+func TestQuota(t *testing.T) {
+	server := kvdroid.NewServer(&kvdroid.ServerOptions{
+		Port:         -1,
+		Quotas:       map[string]kvdroid.Quota{"job2": {MaxKeys: 2}},
+		DefaultQuota: kvdroid.Quota{MaxBytes: 10},
+	})
+	go server.Start()
+	defer server.Shutdown()
+	client := kvdroid.NewClient(server.Addr())
+	defer client.Close()
+
+	util.Ok(t, client.SetBytes("foo", []byte("01234")))
+	util.Ok(t, client.SetBytesRange("bar", 2, []byte("ab")))
+	util.Equals(t, kvdroid.ErrQuotaExceeded, client.SetBytes("baz", []byte("01")), "should raise QuotaExceeded error")
+	util.Equals(t, kvdroid.ErrQuotaExceeded, client.SetBytesRange("foo", 4, []byte("abc")), "should raise QuotaExceeded error")
+	_, err := client.AppendBytes("bar", []byte("abc"))
+	util.Equals(t, kvdroid.ErrQuotaExceeded, err, "should raise QuotaExceeded error")
+	util.Equals(t, false, client.Exists("baz"), "rejected key should not exist")
+	data, _ := client.GetBytes("foo")
+	util.Equals(t, []byte("01234"), data, "rejected range should not be written")
+
+	// overwriting within the quota and freeing space is allowed
+	util.Ok(t, client.SetBytesRange("foo", 3, []byte("ab")))
+	client.DelBytes("bar")
+	util.Ok(t, client.SetBytes("baz", []byte("01234")))
+
+	info := client.Info()
+	util.Equals(t, kvdroid.NamespaceInfo{Keys: 2, Bytes: 10, MaxBytes: 10}, info.Namespaces[kvdroid.DefaultNamespace], "default namespace info should match")
+
+	// the key quota of job2 only applies to new keys
+	util.Ok(t, client.Select("job2"))
+	util.Ok(t, client.SetBytes("foo", []byte("01234567890123456789")))
+	client.SetUint("bar", 1)
+	util.Equals(t, kvdroid.ErrQuotaExceeded, client.SetBytes("baz", []byte("0")), "should raise QuotaExceeded error")
+	util.Ok(t, client.SetBytes("bar", []byte("0")))
+
+	// nor to counters
+	util.Equals(t, kvdroid.ErrQuotaExceeded, client.SetUint("baz", 1), "should raise QuotaExceeded error")
+	_, err = client.IncrUint("baz")
+	util.Equals(t, kvdroid.ErrQuotaExceeded, err, "should raise QuotaExceeded error")
+	util.Equals(t, kvdroid.ErrQuotaExceeded, client.SetInt64IfMax("baz", 1), "should raise QuotaExceeded error")
+	util.Equals(t, false, client.Exists("baz"), "rejected key should not exist")
+	util.Ok(t, client.SetUint64("foo", 1))
+
+	// nor to a move which keeps values of other types in the source key
+	util.Equals(t, kvdroid.ErrQuotaExceeded, client.RenameUint("bar", "baz"), "should raise QuotaExceeded error")
+	util.Ok(t, client.DelBytes("bar"))
+	util.Ok(t, client.RenameUint("bar", "baz"))
+	client.Flush()
+	util.Ok(t, client.SetBytes("baz", []byte("0")))
+	info = client.Info()
+	util.Equals(t, kvdroid.NamespaceInfo{Keys: 1, Bytes: 1, MaxKeys: 2}, info.Namespaces["job2"], "job2 namespace info should match")
+}
+
+func TestRename(t *testing.T) {
+	server, client := initClientServer()
+	defer server.Shutdown()
+	defer client.Close()
+
+	// keys in different buckets
+	for i := 0; i < 10; i++ {
+		client.SetBytes(fmt.Sprintf("tmp%d", i), []byte(fmt.Sprintf("chunk%d", i)))
+	}
+	for i := 0; i < 10; i++ {
+		util.Ok(t, client.RenameBytes(fmt.Sprintf("tmp%d", i), fmt.Sprintf("chunk%d", i)))
+	}
+	for i := 0; i < 10; i++ {
+		util.Equals(t, false, client.Exists(fmt.Sprintf("tmp%d", i)), "source should be deleted")
+		data, err := client.GetBytes(fmt.Sprintf("chunk%d", i))
+		util.Ok(t, err)
+		util.Equals(t, []byte(fmt.Sprintf("chunk%d", i)), data, "value should be moved")
+	}
+	util.Equals(t, kvdroid.ErrKeyNotFound, client.RenameBytes("tmp0", "chunk0"), "should raise KeyNotFound error")
+	util.Equals(t, kvdroid.ErrKeyExists, client.RenameBytesIfNotExists("chunk0", "chunk1"), "should raise KeyExists error")
+	util.Ok(t, client.RenameBytesIfNotExists("chunk0", "final0"))
+
+	// the copy does not share its memory with the source
+	util.Ok(t, client.CopyBytes("chunk1", "copy1"))
+	client.SetBytesRange("chunk1", 0, []byte("C"))
+	data, _ := client.GetBytes("copy1")
+	util.Equals(t, []byte("chunk1"), data, "copy should not change")
+	data, _ = client.GetBytes("chunk1")
+	util.Equals(t, []byte("Chunk1"), data, "source should change")
+
+	// only the values of the given type are renamed
+	client.SetUint("chunk2", 2)
+	util.Ok(t, client.RenameUint("chunk2", "count"))
+	util.Equals(t, kvdroid.TypeUint, typeOf(client, "count"), "only the uint should be moved")
+	util.Equals(t, kvdroid.TypeBytes, typeOf(client, "chunk2"), "the bytes should remain")
+	util.Ok(t, client.CopyUint("count", "count2"))
+	val, _ := client.GetUint("count2")
+	util.Equals(t, uint32(2), val, "uint should be copied")
+	util.Equals(t, kvdroid.ErrKeyExists, client.RenameUintIfNotExists("count", "count2"), "should raise KeyExists error")
+}
+
+func typeOf(client *kvdroid.Client, key string) kvdroid.ValueType {
+	typ, _ := client.Type(key)
+	return typ
+}
+
+func TestCopyRange(t *testing.T) {
+	server, client := initClientServer()
+	defer server.Shutdown()
+	defer client.Close()
+
+	client.SetBytes("src", []byte("0123456789"))
+	n, err := client.CopyRange("src", 2, 5, "dst", 3)
+	util.Ok(t, err)
+	util.Equals(t, uint32(4), n, "wrong number of bytes copied")
+	data, _ := client.GetBytes("dst")
+	util.Equals(t, []byte("\x00\x00\x002345"), data, "missing key should be created")
+
+	// the range is truncated to the size of the source
+	n, err = client.CopyRange("src", 8, 20, "dst", 1)
+	util.Ok(t, err)
+	util.Equals(t, uint32(2), n, "wrong number of bytes copied")
+	data, _ = client.GetBytes("dst")
+	util.Equals(t, []byte("\x00892345"), data, "range should be copied")
+	_, err = client.CopyRange("missing", 0, 1, "dst", 0)
+	util.Equals(t, kvdroid.ErrKeyNotFound, err, "should raise KeyNotFound error")
+
+	// overlapping ranges within the same key
+	client.CopyRange("src", 0, 5, "src", 2)
+	data, _ = client.GetBytes("src")
+	util.Equals(t, []byte("0101234589"), data, "forward overlap should be handled")
+	client.CopyRange("src", 2, 9, "src", 0)
+	data, _ = client.GetBytes("src")
+	util.Equals(t, []byte("0123458989"), data, "backward overlap should be handled")
+	client.CopyRange("src", 4, 9, "src", 8)
+	data, _ = client.GetBytes("src")
+	util.Equals(t, []byte("01234589458989"), data, "overlap beyond the end should be handled")
+}
+
+func TestConcat(t *testing.T) {
+	server := kvdroid.NewServer(&kvdroid.ServerOptions{Port: -1, StorageCompressionThreshold: 100, StorageBlockSize: 64})
+	go server.Start()
+	defer server.Shutdown()
+	client := kvdroid.NewClient(server.Addr())
+	defer client.Close()
+
+	var pieces [][]byte
+	for i := 0; i < 5; i++ {
+		piece := bytes.Repeat([]byte{byte('a' + i)}, 50*i)
+		pieces = append(pieces, piece)
+		client.SetBytes(fmt.Sprintf("piece%d", i), piece)
+	}
+	n, err := client.Concat("array", "piece3", "piece0", "piece1", "piece4", "piece2")
+	util.Ok(t, err)
+	expected := bytes.Join([][]byte{pieces[3], pieces[0], pieces[1], pieces[4], pieces[2]}, nil)
+	util.Equals(t, uint32(len(expected)), n, "wrong length")
+	data, _ := client.GetBytes("array")
+	util.Equals(t, expected, data, "pieces should be concatenated")
+
+	// the destination may be one of the sources
+	n, err = client.Concat("array", "piece1", "array", "piece1")
+	util.Ok(t, err)
+	expected = bytes.Join([][]byte{pieces[1], expected, pieces[1]}, nil)
+	util.Equals(t, uint32(len(expected)), n, "wrong length")
+	data, _ = client.GetBytes("array")
+	util.Equals(t, expected, data, "pieces should be concatenated")
+
+	_, err = client.Concat("array", "piece1", "missing")
+	util.Equals(t, kvdroid.ErrKeyNotFound, err, "should raise KeyNotFound error")
+	data, _ = client.GetBytes("array")
+	util.Equals(t, expected, data, "destination should be untouched")
+
+	// ranges of compressed values
+	client.CopyRange("array", 0, 249, "array", 100)
+	expected = append(append(append([]byte{}, expected[:100]...), expected[:250]...), expected[350:]...)
+	data, _ = client.GetBytes("array")
+	util.Equals(t, expected, data, "overlapping range should be copied")
+	util.Assert(t, client.Info().CompressedBytes > 0, "values should be compressed")
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+
+	"github.com/JCapul/kvdroid"
+)
+
+func usage() {
+	fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [options] <command>\n\nCommands:\n", os.Args[0])
+	fmt.Fprint(flag.CommandLine.Output(), "  monitor\tprint the commands processed by the server\n\nOptions:\n")
+	flag.PrintDefaults()
+}
+
+func monitor(client *kvdroid.Client) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	go func() {
+		<-interrupt
+		cancel()
+	}()
+
+	events, err := client.Monitor(ctx)
+	if err != nil {
+		panic(err)
+	}
+	for event := range events {
+		fmt.Printf("%s [%s] %s %q in=%d out=%d %v\n",
+			event.Time.Format("15:04:05.000000"), event.ClientAddr, event.Command, event.Key,
+			event.RequestBytes, event.ReplyBytes, event.Duration)
+	}
+}
+
+func main() {
+	host := flag.String("host", "", "kvdroid server hostname")
+	port := flag.Int("port", 8001, "kvdroid server port")
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() != 1 {
+		usage()
+		os.Exit(2)
+	}
+
+	client := kvdroid.NewClient(fmt.Sprintf("%s:%d", *host, *port))
+	defer client.Close()
+
+	switch flag.Arg(0) {
+	case "monitor":
+		monitor(client)
+	default:
+		usage()
+		os.Exit(2)
+	}
+}
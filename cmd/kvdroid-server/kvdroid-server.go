@@ -14,6 +14,14 @@ func main() {
 	port := flag.Int("port", 8001, "port number")
 	buckets := flag.Int("buckets", 100, "number of buckets")
 	daemonize := flag.Bool("daemonize", false, "run the server as a daemon")
+	adminAddr := flag.String("admin-addr", "", "address of the health, readiness and profiling endpoint (disabled if empty)")
+	metricsAddr := flag.String("metrics-addr", "", "address of the Prometheus metrics endpoint (disabled if empty)")
+	compressionThreshold := flag.Int("compression-threshold", 0, "size from which byte payloads are compressed for the clients enabling it (disabled if 0)")
+	storageCompressionThreshold := flag.Int("storage-compression-threshold", 0, "size from which byte values are stored compressed (disabled if 0)")
+	adminToken := flag.String("admin-token", "", "token required by the admin commands such as FlushAll (disabled if empty)")
+	quotaBytes := flag.Int64("quota-bytes", 0, "maximum length of the byte values in each namespace (unlimited if 0)")
+	quotaKeys := flag.Uint64("quota-keys", 0, "maximum number of keys in each namespace (unlimited if 0)")
+	maxNamespaces := flag.Int("max-namespaces", 0, "maximum number of namespaces, including the default one (unlimited if 0)")
 	flag.Parse()
 
 	if *daemonize {
@@ -47,6 +55,13 @@ func main() {
 		Bind: *bind,
 		Port: *port,
 		Buckets: *buckets,
+		MetricsAddr: *metricsAddr,
+		AdminAddr: *adminAddr,
+		CompressionThreshold: *compressionThreshold,
+		StorageCompressionThreshold: *storageCompressionThreshold,
+		AdminToken: *adminToken,
+		DefaultQuota: kvdroid.Quota{MaxBytes: *quotaBytes, MaxKeys: *quotaKeys},
+		MaxNamespaces: *maxNamespaces,
 	}
 	server := kvdroid.NewServer(&opts)
 	server.Start()
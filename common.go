@@ -2,8 +2,10 @@ package kvdroid
 
 import (
 	"encoding/binary"
+	"fmt"
 	"io"
-	"net"
+	"strings"
+	"unicode/utf8"
 )
 
 /* Helpers */
@@ -16,6 +18,46 @@ func try(err error) {
 
 var check = try
 
+// matchGlob reports whether name matches the shell pattern, which supports
+// '*', '?' and backslash escapes. Unlike path.Match, '*' also matches '/'.
+func matchGlob(pattern, name string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			pattern = strings.TrimLeft(pattern, "*")
+			if pattern == "" {
+				return true
+			}
+			for i := 0; i <= len(name); i++ {
+				if matchGlob(pattern, name[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if name == "" {
+				return false
+			}
+			_, n := utf8.DecodeRuneInString(name)
+			name = name[n:]
+			pattern = pattern[1:]
+		case '\\':
+			pattern = pattern[1:]
+			if pattern == "" {
+				return false
+			}
+			fallthrough
+		default:
+			if name == "" || name[0] != pattern[0] {
+				return false
+			}
+			name = name[1:]
+			pattern = pattern[1:]
+		}
+	}
+	return name == ""
+}
+
 /* Enums */
 
 // Message enum
@@ -37,11 +79,222 @@ const (
 	stopCmd
 	ackReply
 	errNoKeyReply
+	// later messages are appended to keep the wire values of existing ones
+	addUintCmd
+	setUintIfMinCmd
+	compareAndSwapUintCmd
+	getAndSetUintCmd
+	setUint64Cmd
+	getUint64Cmd
+	setUint64IfMaxCmd
+	addUint64Cmd
+	delUint64Cmd
+	setInt64Cmd
+	getInt64Cmd
+	setInt64IfMaxCmd
+	addInt64Cmd
+	delInt64Cmd
+	scanCmd
+	existsCmd
+	typeCmd
+	sizeBytesCmd
+	statCmd
+	appendBytesCmd
+	infoCmd
+	slowLogGetCmd
+	slowLogResetCmd
+	monitorCmd
+	subscribeCmd
+	publishCmd
+	errReservedReply
+	waitUintAtLeastCmd
+	waitUintAtMostCmd
+	waitExistsCmd
+	errTimeoutReply
+	lockCmd
+	unlockCmd
+	refreshLockCmd
+	errLockedReply
+	errLockLostReply
+	watchCmd
+	execCmd
+	errTxAbortedReply
+	getBytesVersionCmd
+	getUintVersionCmd
+	setBytesIfVersionCmd
+	setBytesRangeIfVersionCmd
+	delIfVersionCmd
+	errVersionConflictReply
+	setBytesCheckedCmd
+	checksumCmd
+	errChecksumMismatchReply
+	helloCmd
+	unlinkCmd
+	delKeysCmd
+	flushAllCmd
+	errPermissionDeniedReply
+	selectCmd
+	flushCmd
+	errQuotaExceededReply
+	renameCmd
+	renameIfNotExistsCmd
+	copyCmd
+	errKeyExistsReply
+	copyRangeCmd
+	concatCmd
+	errTxInvalidReply
+)
+
+var messageNames = map[Message]string{
+	getBytesCmd:               "GetBytes",
+	getBytesIntoCmd:           "GetBytesInto",
+	getBytesRangeCmd:          "GetBytesRange",
+	getBytesRangeIntoCmd:      "GetBytesRangeInto",
+	setBytesCmd:               "SetBytes",
+	setBytesRangeCmd:          "SetBytesRange",
+	delBytesCmd:               "DelBytes",
+	truncateBytesCmd:          "TruncateBytes",
+	setUintCmd:                "SetUint",
+	getUintCmd:                "GetUint",
+	setUintIfMaxCmd:           "SetUintIfMax",
+	delUintCmd:                "DelUint",
+	stopCmd:                   "Stop",
+	ackReply:                  "Ack",
+	errNoKeyReply:             "ErrNoKey",
+	addUintCmd:                "AddUint",
+	setUintIfMinCmd:           "SetUintIfMin",
+	compareAndSwapUintCmd:     "CompareAndSwapUint",
+	getAndSetUintCmd:          "GetAndSetUint",
+	setUint64Cmd:              "SetUint64",
+	getUint64Cmd:              "GetUint64",
+	setUint64IfMaxCmd:         "SetUint64IfMax",
+	addUint64Cmd:              "AddUint64",
+	delUint64Cmd:              "DelUint64",
+	setInt64Cmd:               "SetInt64",
+	getInt64Cmd:               "GetInt64",
+	setInt64IfMaxCmd:          "SetInt64IfMax",
+	addInt64Cmd:               "AddInt64",
+	delInt64Cmd:               "DelInt64",
+	scanCmd:                   "Scan",
+	existsCmd:                 "Exists",
+	typeCmd:                   "Type",
+	sizeBytesCmd:              "SizeBytes",
+	statCmd:                   "Stat",
+	appendBytesCmd:            "AppendBytes",
+	infoCmd:                   "Info",
+	slowLogGetCmd:             "SlowLogGet",
+	slowLogResetCmd:           "SlowLogReset",
+	monitorCmd:                "Monitor",
+	subscribeCmd:              "Subscribe",
+	publishCmd:                "Publish",
+	errReservedReply:          "ErrReserved",
+	waitUintAtLeastCmd:        "WaitUintAtLeast",
+	waitUintAtMostCmd:         "WaitUintAtMost",
+	waitExistsCmd:             "WaitExists",
+	errTimeoutReply:           "ErrTimeout",
+	lockCmd:                   "Lock",
+	unlockCmd:                 "Unlock",
+	refreshLockCmd:            "RefreshLock",
+	errLockedReply:            "ErrLocked",
+	errLockLostReply:          "ErrLockLost",
+	watchCmd:                  "Watch",
+	execCmd:                   "Exec",
+	errTxAbortedReply:         "ErrTxAborted",
+	getBytesVersionCmd:        "GetBytesVersion",
+	getUintVersionCmd:         "GetUintVersion",
+	setBytesIfVersionCmd:      "SetBytesIfVersion",
+	setBytesRangeIfVersionCmd: "SetBytesRangeIfVersion",
+	delIfVersionCmd:           "DelIfVersion",
+	errVersionConflictReply:   "ErrVersionConflict",
+	setBytesCheckedCmd:        "SetBytesChecked",
+	checksumCmd:               "Checksum",
+	errChecksumMismatchReply:  "ErrChecksumMismatch",
+	helloCmd:                  "Hello",
+	unlinkCmd:                 "Unlink",
+	delKeysCmd:                "DelKeys",
+	flushAllCmd:               "FlushAll",
+	errPermissionDeniedReply:  "ErrPermissionDenied",
+	selectCmd:                 "Select",
+	flushCmd:                  "Flush",
+	errQuotaExceededReply:     "ErrQuotaExceeded",
+	renameCmd:                 "Rename",
+	renameIfNotExistsCmd:      "RenameIfNotExists",
+	copyCmd:                   "Copy",
+	errKeyExistsReply:         "ErrKeyExists",
+	copyRangeCmd:              "CopyRange",
+	concatCmd:                 "Concat",
+	errTxInvalidReply:         "ErrTxInvalid",
+}
+
+var errorReplies = map[Message]bool{
+	errNoKeyReply:            true,
+	errReservedReply:         true,
+	errTimeoutReply:          true,
+	errLockedReply:           true,
+	errLockLostReply:         true,
+	errTxAbortedReply:        true,
+	errVersionConflictReply:  true,
+	errChecksumMismatchReply: true,
+	errPermissionDeniedReply: true,
+	errQuotaExceededReply:    true,
+	errKeyExistsReply:        true,
+	errTxInvalidReply:        true,
+}
+
+// isError returns true for error replies
+func (m Message) isError() bool {
+	return errorReplies[m]
+}
+
+func (m Message) String() string {
+	if name, ok := messageNames[m]; ok {
+		return name
+	}
+	return fmt.Sprintf("Message(%d)", byte(m))
+}
+
+// ValueType is a bit mask of value types. The same key may hold a value of
+// each type.
+type ValueType uint32
+
+const (
+	// TypeBytes is the type of []byte values
+	TypeBytes ValueType = 1 << iota
+	// TypeUint is the type of uint32 values
+	TypeUint
+	// TypeUint64 is the type of uint64 values
+	TypeUint64
+	// TypeInt64 is the type of int64 values
+	TypeInt64
 )
 
+// TypeAny matches values of all types
+const TypeAny = TypeBytes | TypeUint | TypeUint64 | TypeInt64
+
+func (t ValueType) String() string {
+	var names []string
+	for _, v := range []struct {
+		typ  ValueType
+		name string
+	}{
+		{TypeBytes, "bytes"},
+		{TypeUint, "uint"},
+		{TypeUint64, "uint64"},
+		{TypeInt64, "int64"},
+	} {
+		if t&v.typ != 0 {
+			names = append(names, v.name)
+		}
+	}
+	if len(names) == 0 {
+		return "none"
+	}
+	return strings.Join(names, "|")
+}
+
 // Single I/O protocol helpers
 
-func readMessage(conn net.Conn) (Message, error) {
+func readMessage(conn io.Reader) (Message, error) {
 	b := make([]byte, 1, 1)
 	_, err := io.ReadAtLeast(conn, b, 1)
 	if err == io.ErrUnexpectedEOF {
@@ -50,12 +303,12 @@ func readMessage(conn net.Conn) (Message, error) {
 	return Message(b[0]), err
 }
 
-func sendMessage(conn net.Conn, m Message) error {
+func sendMessage(conn io.Writer, m Message) error {
 	_, err := conn.Write([]byte{byte(m)})
 	return err
 }
 
-func readUint32(conn net.Conn) (uint32, error) {
+func readUint32(conn io.Reader) (uint32, error) {
 	b := make([]byte, 4, 4)
 	_, err := io.ReadAtLeast(conn, b, 4)
 	if err == io.ErrUnexpectedEOF {
@@ -64,14 +317,57 @@ func readUint32(conn net.Conn) (uint32, error) {
 	return binary.LittleEndian.Uint32(b), err
 }
 
-func sendUint32(conn net.Conn, value uint32) error {
+func sendUint32(conn io.Writer, value uint32) error {
 	b := make([]byte, 4, 4)
 	binary.LittleEndian.PutUint32(b, value)
 	_, err := conn.Write(b)
 	return err
 }
 
-func readFillBuf(conn net.Conn, dst []byte) error {
+func readUint64(conn io.Reader) (uint64, error) {
+	b := make([]byte, 8, 8)
+	_, err := io.ReadAtLeast(conn, b, 8)
+	if err == io.ErrUnexpectedEOF {
+		panic(err)
+	}
+	return binary.LittleEndian.Uint64(b), err
+}
+
+func sendUint64(conn io.Writer, value uint64) error {
+	b := make([]byte, 8, 8)
+	binary.LittleEndian.PutUint64(b, value)
+	_, err := conn.Write(b)
+	return err
+}
+
+func readInt64(conn io.Reader) (int64, error) {
+	val, err := readUint64(conn)
+	return int64(val), err
+}
+
+func sendInt64(conn io.Writer, value int64) error {
+	return sendUint64(conn, uint64(value))
+}
+
+func readBool(conn io.Reader) (bool, error) {
+	b := make([]byte, 1, 1)
+	_, err := io.ReadAtLeast(conn, b, 1)
+	if err == io.ErrUnexpectedEOF {
+		panic(err)
+	}
+	return b[0] != 0, err
+}
+
+func sendBool(conn io.Writer, value bool) error {
+	b := []byte{0}
+	if value {
+		b[0] = 1
+	}
+	_, err := conn.Write(b)
+	return err
+}
+
+func readFillBuf(conn io.Reader, dst []byte) error {
 	_, err := io.ReadAtLeast(conn, dst, len(dst))
 	if err == io.ErrUnexpectedEOF {
 		panic(err)
@@ -81,28 +377,31 @@ func readFillBuf(conn net.Conn, dst []byte) error {
 
 // multi I/O protocol helpers
 
-func sendBytes(conn net.Conn, data []byte) error {
+func sendBytes(conn io.Writer, data []byte) error {
+	if threshold := thresholdOf(conn); threshold > 0 {
+		return sendPayload(conn, data, threshold)
+	}
 	sendUint32(conn, uint32(len(data)))
 	_, err := conn.Write(data)
 	return err
 }
 
-func readBytes(conn net.Conn) ([]byte, error) {
-	size, err := readUint32(conn)
+func readBytes(conn io.Reader) ([]byte, error) {
+	size, payload, err := readPayload(conn)
 	if err != nil {
 		return nil, err
 	}
 	b := make([]byte, size, size)
-	err = readFillBuf(conn, b)
+	err = readFillBuf(payload, b)
 	return b, err
 }
 
-func readBytesInto(conn net.Conn, dst []byte) (uint32, error) {
-	size, err := readUint32(conn)
+func readBytesInto(conn io.Reader, dst []byte) (uint32, error) {
+	size, payload, err := readPayload(conn)
 	if err != nil {
 		return 0, err
 	}
-	_, err = io.ReadAtLeast(conn, dst, int(size))
+	_, err = io.ReadAtLeast(payload, dst, int(size))
 	if err == io.ErrUnexpectedEOF {
 		panic(err)
 	}
@@ -112,7 +411,7 @@ func readBytesInto(conn net.Conn, dst []byte) (uint32, error) {
 	return size, nil
 }
 
-func readString(conn net.Conn) (string, error) {
+func readString(conn io.Reader) (string, error) {
 	b, err := readBytes(conn)
 	return string(b), err
 }
@@ -0,0 +1,146 @@
+package kvdroid
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+)
+
+// On the connections which negotiated compression, byte payloads start with
+// a flag telling whether they are deflated. A deflated payload is followed by
+// its uncompressed size after its size.
+const (
+	plainPayload byte = iota
+	deflatedPayload
+)
+
+// compressor is implemented by the connections which negotiated compression
+type compressor interface {
+	// compressThreshold is the size from which byte payloads are
+	// compressed, 0 if compression is disabled
+	compressThreshold() int
+}
+
+var flateWriters = sync.Pool{
+	New: func() interface{} {
+		w, err := flate.NewWriter(nil, flate.BestSpeed)
+		check(err)
+		return w
+	},
+}
+
+// deflate compresses data, returning nil if it does not shrink
+func deflate(data []byte) []byte {
+	var buf bytes.Buffer
+	w := flateWriters.Get().(*flate.Writer)
+	defer flateWriters.Put(w)
+	w.Reset(&buf)
+	_, err := w.Write(data)
+	check(err)
+	check(w.Close())
+	if buf.Len() >= len(data) {
+		return nil
+	}
+	return buf.Bytes()
+}
+
+// thresholdOf returns the compression threshold negotiated by conn, 0 if
+// compression is disabled
+func thresholdOf(conn interface{}) int {
+	if c, ok := conn.(compressor); ok {
+		return c.compressThreshold()
+	}
+	return 0
+}
+
+// sendPayload sends data on a connection which negotiated compression,
+// deflated from threshold bytes if it shrinks
+func sendPayload(conn io.Writer, data []byte, threshold int) error {
+	if len(data) >= threshold {
+		if deflated := deflate(data); deflated != nil {
+			header := make([]byte, 9)
+			header[0] = deflatedPayload
+			binary.LittleEndian.PutUint32(header[1:], uint32(len(deflated)))
+			binary.LittleEndian.PutUint32(header[5:], uint32(len(data)))
+			if _, err := conn.Write(header); err != nil {
+				return err
+			}
+			_, err := conn.Write(deflated)
+			return err
+		}
+	}
+	header := make([]byte, 5)
+	header[0] = plainPayload
+	binary.LittleEndian.PutUint32(header[1:], uint32(len(data)))
+	if _, err := conn.Write(header); err != nil {
+		return err
+	}
+	_, err := conn.Write(data)
+	return err
+}
+
+// readPayload reads the size of a byte payload and returns a reader of its
+// uncompressed content
+func readPayload(conn io.Reader) (uint32, io.Reader, error) {
+	if thresholdOf(conn) == 0 {
+		size, err := readUint32(conn)
+		return size, conn, err
+	}
+	flag := make([]byte, 1)
+	if err := readFillBuf(conn, flag); err != nil {
+		return 0, nil, err
+	}
+	size, err := readUint32(conn)
+	if err != nil || flag[0] == plainPayload {
+		return size, conn, err
+	}
+	rawSize, err := readUint32(conn)
+	if err != nil {
+		return 0, nil, err
+	}
+	// reading the whole deflate stream ensures nothing is left on conn
+	data := make([]byte, size)
+	if err := readFillBuf(conn, data); err != nil {
+		return 0, nil, err
+	}
+	return rawSize, flate.NewReader(bytes.NewReader(data)), nil
+}
+
+// negotiateThreshold returns the compression threshold agreed by both ends
+// of a connection, compression is disabled unless both enable it
+func negotiateThreshold(a, b int) int {
+	if a <= 0 || b <= 0 {
+		return 0
+	}
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// clientConn is the connection of a client
+type clientConn struct {
+	net.Conn
+	threshold int
+}
+
+func (c *clientConn) compressThreshold() int {
+	return c.threshold
+}
+
+func (c *serverConn) compressThreshold() int {
+	return c.threshold
+}
+
+// Hello negotiates the options of the connection
+func (s *Store) Hello(conn net.Conn) {
+	threshold, err := readUint32(conn)
+	check(err)
+	threshold = uint32(negotiateThreshold(int(threshold), s.compressThreshold))
+	try(sendMessage(conn, ackReply))
+	try(sendUint32(conn, threshold))
+	conn.(*serverConn).threshold = int(threshold)
+}
@@ -0,0 +1,97 @@
+package kvdroid
+
+import (
+	"net"
+)
+
+// writeRange writes data at offset start of the byte value of key, which is
+// created or extended as needed. data may overlap the value. It must be
+// called with the write lock held.
+func (b *Bucket) writeRange(key string, start uint32, data []byte) {
+	if v, ok := b.blobs[key]; ok {
+		b.updateBlob(key, v, func(v *blob) { v.writeAt(data, int(start)) })
+		return
+	}
+	end := start + uint32(len(data))
+	actualData, ok := b.bytedata[key]
+	if ok && end <= uint32(len(actualData)) {
+		// range is within existing array, copy handles the overlap
+		copy(actualData[start:end], data)
+		b.touchBytes(key)
+		return
+	}
+	// data still points to the previous array if append moves it
+	newData := actualData
+	if end > uint32(len(actualData)) {
+		newData = append(actualData, make([]byte, end-uint32(len(actualData)))...)
+	}
+	copy(newData[start:end], data)
+	b.setBytes(key, newData)
+}
+
+// CopyRange copies the byte range [srcStart, srcEnd] of a key to key at
+// offset start. Like GetBytesRange, the range is truncated to the size of
+// the value.
+func (s *Store) CopyRange(bucket *Bucket, key string, conn net.Conn) {
+	start, err := readUint32(conn)
+	check(err)
+	srcKey, err := readString(conn)
+	check(err)
+	srcStart, err := readUint32(conn)
+	check(err)
+	srcEnd, err := readUint32(conn)
+	check(err)
+	srcEnd++ // srcEnd is the last byte included, like in GetBytesRange
+
+	ns := namespaceOf(conn)
+	buckets := ns.lockKeys(key, srcKey)
+	defer unlockBuckets(buckets)
+	data, ok := ns.getBucket(srcKey).rangeOf(srcKey, srcStart, srcEnd)
+	if !ok {
+		try(sendMessage(conn, errNoKeyReply))
+		return
+	}
+	if !bucket.allows(key, start+uint32(len(data))) {
+		try(sendMessage(conn, errQuotaExceededReply))
+		return
+	}
+	if len(data) > 0 {
+		bucket.writeRange(key, start, data)
+		notify(conn, EventSetRange, key)
+	}
+	try(sendMessage(conn, ackReply))
+	try(sendUint32(conn, uint32(len(data))))
+}
+
+// Concat sets the byte value of key to the concatenation of the byte values
+// of other keys, which may include key itself.
+func (s *Store) Concat(bucket *Bucket, key string, conn net.Conn) {
+	srcKeys, err := readStrings(conn)
+	check(err)
+
+	ns := namespaceOf(conn)
+	buckets := ns.lockKeys(append(srcKeys, key)...)
+	defer unlockBuckets(buckets)
+	var size uint32
+	for _, srcKey := range srcKeys {
+		n, ok := ns.getBucket(srcKey).sizeOf(srcKey)
+		if !ok {
+			try(sendMessage(conn, errNoKeyReply))
+			return
+		}
+		size += n
+	}
+	if !bucket.allows(key, size) {
+		try(sendMessage(conn, errQuotaExceededReply))
+		return
+	}
+	data := make([]byte, 0, size)
+	for _, srcKey := range srcKeys {
+		piece, _ := ns.getBucket(srcKey).bytesOf(srcKey)
+		data = append(data, piece...)
+	}
+	bucket.setBytes(key, data)
+	notify(conn, EventSet, key)
+	try(sendMessage(conn, ackReply))
+	try(sendUint32(conn, size))
+}
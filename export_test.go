@@ -0,0 +1,27 @@
+package kvdroid
+
+// QueueRaw queues cmd with args as they are sent, bypassing the checks of the
+// client API, to test how the server handles malformed transactions
+func (tx *Tx) QueueRaw(cmd Message, key string, args []byte) {
+	tx.args.Write(args)
+	tx.queue(cmd, key, ackReplyFunc)
+}
+
+// CorruptBytes flips the first stored byte of the byte value of key, or of
+// its last block if it is compressed, to test the checks of the reads
+func (s *Server) CorruptBytes(key string) {
+	bucket := s.store.namespace(DefaultNamespace).getBucket(key)
+	bucket.lock()
+	defer bucket.unlock()
+	if v, ok := bucket.blobs[key]; ok {
+		v.blocks[len(v.blocks)-1].data[0] ^= 0xff
+	} else {
+		bucket.bytedata[key][0] ^= 0xff
+	}
+}
+
+// Messages of the wire protocol used by the tests
+const (
+	SetUintCmd = setUintCmd
+	SelectCmd  = selectCmd
+)
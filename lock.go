@@ -0,0 +1,154 @@
+package kvdroid
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// lease is a lock held until it expires or is unlocked
+type lease struct {
+	token   uint64
+	expires time.Time
+}
+
+// leaseSweepInterval is the period at which the expired leases of the locks
+// nobody took again are removed
+const leaseSweepInterval = time.Minute
+
+// sweepLeases removes the expired leases of all the buckets every interval
+// until the store is closed
+func (s *Store) sweepLeases(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.done:
+			return
+		}
+		for _, ns := range s.sortedNamespaces() {
+			for _, bucket := range ns.buckets {
+				// the sweep is not counted as lock contention
+				bucket.mtx.Lock()
+				bucket.dropExpiredLeases(time.Now())
+				bucket.mtx.Unlock()
+			}
+		}
+	}
+}
+
+// dropExpiredLeases removes the leases expired at now, it must be called
+// with the write lock held
+func (b *Bucket) dropExpiredLeases(now time.Time) {
+	for key, held := range b.locks {
+		if !now.Before(held.expires) {
+			delete(b.locks, key)
+		}
+	}
+}
+
+// Lock ...
+func (s *Store) Lock(bucket *Bucket, key string, conn net.Conn) {
+	ttl, err := readInt64(conn)
+	check(err)
+	block, err := readBool(conn)
+	check(err)
+	timeout, err := readInt64(conn)
+	check(err)
+
+	var expired <-chan time.Time
+	if block && timeout > 0 {
+		timer := time.NewTimer(time.Duration(timeout))
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	var closed <-chan struct{}
+	bucket.lock()
+	defer bucket.unlock()
+	for {
+		now := time.Now()
+		held, ok := bucket.locks[key]
+		if !ok || !now.Before(held.expires) {
+			token := atomic.AddUint64(&s.fence, 1)
+			bucket.locks[key] = &lease{token: token, expires: now.Add(time.Duration(ttl))}
+			try(sendMessage(conn, ackReply))
+			try(sendUint64(conn, token))
+			return
+		}
+		if !block {
+			try(sendMessage(conn, errLockedReply))
+			return
+		}
+
+		// wait for an unlock or the lease expiry
+		if closed == nil {
+			var stop func()
+			closed, stop = watchConn(conn)
+			defer stop()
+		}
+		ch := bucket.addWaiter(key)
+		bucket.unlock()
+		leaseExpired := time.NewTimer(held.expires.Sub(now))
+		timedOut, disconnected := false, false
+		select {
+		case <-ch:
+		case <-leaseExpired.C:
+		case <-expired:
+			timedOut = true
+		case <-closed:
+			disconnected = true
+		case <-s.done:
+			timedOut = true
+		}
+		leaseExpired.Stop()
+		bucket.lock()
+		bucket.removeWaiter(key, ch)
+		if disconnected {
+			return
+		}
+		if timedOut {
+			try(sendMessage(conn, errTimeoutReply))
+			return
+		}
+	}
+}
+
+// Unlock ...
+func (s *Store) Unlock(bucket *Bucket, key string, conn net.Conn) {
+	bucket.lock()
+	defer bucket.unlock()
+	token, err := readUint64(conn)
+	check(err)
+	held, ok := bucket.locks[key]
+	if !ok || held.token != token {
+		try(sendMessage(conn, errLockLostReply))
+	} else {
+		delete(bucket.locks, key)
+		bucket.wake(key)
+		try(sendMessage(conn, ackReply))
+	}
+}
+
+// RefreshLock ...
+func (s *Store) RefreshLock(bucket *Bucket, key string, conn net.Conn) {
+	bucket.lock()
+	defer bucket.unlock()
+	token, err := readUint64(conn)
+	check(err)
+	ttl, err := readInt64(conn)
+	check(err)
+	held, ok := bucket.locks[key]
+	if ok && !time.Now().Before(held.expires) {
+		// an expired lease is lost, even if nobody took the lock
+		delete(bucket.locks, key)
+		ok = false
+	}
+	if !ok || held.token != token {
+		try(sendMessage(conn, errLockLostReply))
+	} else {
+		held.expires = time.Now().Add(time.Duration(ttl))
+		try(sendMessage(conn, ackReply))
+	}
+}
@@ -0,0 +1,137 @@
+package kvdroid
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"runtime"
+	"sort"
+	"sync/atomic"
+)
+
+// httpServer is an auxiliary HTTP endpoint of a Server
+type httpServer struct {
+	addr     string
+	listener net.Listener
+	server   *http.Server
+}
+
+func newHTTPServer(addr string, handler http.Handler) *httpServer {
+	l, err := net.Listen("tcp", addr)
+	check(err)
+	return &httpServer{
+		addr:     l.Addr().String(),
+		listener: l,
+		server:   &http.Server{Handler: handler},
+	}
+}
+
+func (h *httpServer) serve() {
+	err := h.server.Serve(h.listener)
+	if err != http.ErrServerClosed {
+		log.Printf("kvdroid: http server on %s failed: %v", h.addr, err)
+	}
+}
+
+func (h *httpServer) close() error {
+	return h.server.Close()
+}
+
+// serveMetrics writes the store metrics in the Prometheus text format
+func (s *Store) serveMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	bw := bufio.NewWriter(w)
+	defer bw.Flush()
+
+	info := s.info()
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+
+	metric := func(name, typ, help string, value interface{}) {
+		fmt.Fprintf(bw, "# HELP %s %s\n# TYPE %s %s\n%s %v\n", name, help, name, typ, name, value)
+	}
+	metric("kvdroid_uptime_seconds", "gauge", "Time since the server started.", info.Uptime.Seconds())
+	metric("kvdroid_connected_clients", "gauge", "Number of open client connections.", info.ConnectedClients)
+	metric("kvdroid_connections_total", "counter", "Number of accepted client connections.", info.TotalConnections)
+	metric("kvdroid_received_bytes_total", "counter", "Bytes received from clients.", info.BytesIn)
+	metric("kvdroid_sent_bytes_total", "counter", "Bytes sent to clients.", info.BytesOut)
+	metric("kvdroid_keys", "gauge", "Number of distinct keys.", info.Keys)
+	metric("kvdroid_stored_bytes", "gauge", "Total length of the byte values.", info.Bytes)
+	metric("kvdroid_compressed_bytes", "gauge", "Total length of the byte values stored compressed.", info.CompressedBytes)
+	metric("kvdroid_compressed_size_bytes", "gauge", "Memory used by the byte values stored compressed.", info.CompressedSize)
+	metric("kvdroid_heap_inuse_bytes", "gauge", "Bytes in in-use heap spans.", mem.HeapInuse)
+
+	fmt.Fprint(bw, "# HELP kvdroid_bucket_lock_contentions_total Bucket lock acquisitions which had to wait.\n")
+	fmt.Fprint(bw, "# TYPE kvdroid_bucket_lock_contentions_total counter\n")
+	for _, bucket := range info.Buckets {
+		fmt.Fprintf(bw, "kvdroid_bucket_lock_contentions_total{bucket=%q} %d\n", bucket.Name, bucket.Contended)
+	}
+
+	namespaces := make([]string, 0, len(info.Namespaces))
+	for name := range info.Namespaces {
+		namespaces = append(namespaces, name)
+	}
+	sort.Strings(namespaces)
+	fmt.Fprint(bw, "# HELP kvdroid_namespace_keys Number of distinct keys in a namespace.\n")
+	fmt.Fprint(bw, "# TYPE kvdroid_namespace_keys gauge\n")
+	for _, name := range namespaces {
+		fmt.Fprintf(bw, "kvdroid_namespace_keys{namespace=%q} %d\n", name, info.Namespaces[name].Keys)
+	}
+	fmt.Fprint(bw, "# HELP kvdroid_namespace_stored_bytes Total length of the byte values in a namespace.\n")
+	fmt.Fprint(bw, "# TYPE kvdroid_namespace_stored_bytes gauge\n")
+	for _, name := range namespaces {
+		fmt.Fprintf(bw, "kvdroid_namespace_stored_bytes{namespace=%q} %d\n", name, info.Namespaces[name].Bytes)
+	}
+	fmt.Fprint(bw, "# HELP kvdroid_namespace_quota_keys Maximum number of keys in a namespace (0 if unlimited).\n")
+	fmt.Fprint(bw, "# TYPE kvdroid_namespace_quota_keys gauge\n")
+	for _, name := range namespaces {
+		fmt.Fprintf(bw, "kvdroid_namespace_quota_keys{namespace=%q} %d\n", name, info.Namespaces[name].MaxKeys)
+	}
+	fmt.Fprint(bw, "# HELP kvdroid_namespace_quota_bytes Maximum length of the byte values in a namespace (0 if unlimited).\n")
+	fmt.Fprint(bw, "# TYPE kvdroid_namespace_quota_bytes gauge\n")
+	for _, name := range namespaces {
+		fmt.Fprintf(bw, "kvdroid_namespace_quota_bytes{namespace=%q} %d\n", name, info.Namespaces[name].MaxBytes)
+	}
+
+	fmt.Fprint(bw, "# HELP kvdroid_requests_total Number of commands processed.\n")
+	fmt.Fprint(bw, "# TYPE kvdroid_requests_total counter\n")
+	for i := range s.stats.ops {
+		if n := atomic.LoadUint64(&s.stats.ops[i]); n > 0 {
+			fmt.Fprintf(bw, "kvdroid_requests_total{command=%q} %d\n", Message(i), n)
+		}
+	}
+
+	fmt.Fprint(bw, "# HELP kvdroid_errors_total Number of commands which replied with an error.\n")
+	fmt.Fprint(bw, "# TYPE kvdroid_errors_total counter\n")
+	for i := range s.stats.errors {
+		if n := atomic.LoadUint64(&s.stats.errors[i]); n > 0 {
+			fmt.Fprintf(bw, "kvdroid_errors_total{command=%q} %d\n", Message(i), n)
+		}
+	}
+
+	fmt.Fprint(bw, "# HELP kvdroid_request_duration_seconds Command processing latency.\n")
+	fmt.Fprint(bw, "# TYPE kvdroid_request_duration_seconds histogram\n")
+	for i := range s.stats.latency {
+		h := &s.stats.latency[i]
+		var counts [len(h.counts)]uint64
+		total := uint64(0)
+		for j := range h.counts {
+			counts[j] = atomic.LoadUint64(&h.counts[j])
+			total += counts[j]
+		}
+		if total == 0 {
+			continue
+		}
+		cmd := Message(i)
+		cumulative := uint64(0)
+		for j, bound := range latencyBuckets {
+			cumulative += counts[j]
+			fmt.Fprintf(bw, "kvdroid_request_duration_seconds_bucket{command=%q,le=\"%g\"} %d\n", cmd, bound.Seconds(), cumulative)
+		}
+		fmt.Fprintf(bw, "kvdroid_request_duration_seconds_bucket{command=%q,le=\"+Inf\"} %d\n", cmd, total)
+		fmt.Fprintf(bw, "kvdroid_request_duration_seconds_sum{command=%q} %g\n", cmd, float64(atomic.LoadUint64(&h.sum))/1e9)
+		fmt.Fprintf(bw, "kvdroid_request_duration_seconds_count{command=%q} %d\n", cmd, total)
+	}
+}
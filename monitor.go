@@ -0,0 +1,106 @@
+package kvdroid
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+// MonitorEvent describes a command processed by the server
+type MonitorEvent struct {
+	SlowLogEntry
+	// Err is set on the last event of a stream which could not be decoded
+	Err error `json:"-"`
+}
+
+// monitorBacklog is the number of events buffered for each monitor before
+// events are dropped
+const monitorBacklog = 1024
+
+// monitors broadcasts the processed commands to the monitor connections
+type monitors struct {
+	// number of monitors, accessed atomically to skip publishing when
+	// nobody listens
+	n    int32
+	mtx  sync.Mutex
+	subs map[chan MonitorEvent]struct{}
+}
+
+func newMonitors() *monitors {
+	return &monitors{
+		subs: make(map[chan MonitorEvent]struct{}),
+	}
+}
+
+func (m *monitors) add() chan MonitorEvent {
+	events := make(chan MonitorEvent, monitorBacklog)
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	m.subs[events] = struct{}{}
+	atomic.AddInt32(&m.n, 1)
+	return events
+}
+
+func (m *monitors) remove(events chan MonitorEvent) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	delete(m.subs, events)
+	atomic.AddInt32(&m.n, -1)
+}
+
+// active tells whether any monitor listens
+func (m *monitors) active() bool {
+	return atomic.LoadInt32(&m.n) > 0
+}
+
+func (m *monitors) publish(event MonitorEvent) {
+	if !m.active() {
+		return
+	}
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	for events := range m.subs {
+		select {
+		case events <- event:
+		default:
+			// slow monitor, drop the event
+		}
+	}
+}
+
+// watchClose returns a channel closed once the client closes a stream
+// connection, on which it sends nothing more
+func watchClose(conn net.Conn) <-chan struct{} {
+	closed := make(chan struct{})
+	go func() {
+		io.Copy(io.Discard, conn)
+		close(closed)
+	}()
+	return closed
+}
+
+// Monitor turns the connection into a stream of the processed commands,
+// until the client closes it or the server stops.
+func (s *Store) Monitor(conn net.Conn) {
+	events := s.monitors.add()
+	defer s.monitors.remove(events)
+	try(sendMessage(conn, ackReply))
+
+	closed := watchClose(conn)
+	for {
+		select {
+		case event := <-events:
+			data, err := json.Marshal(event)
+			check(err)
+			if sendBytes(conn, data) != nil {
+				return
+			}
+		case <-closed:
+			return
+		case <-s.done:
+			return
+		}
+	}
+}
@@ -0,0 +1,193 @@
+package kvdroid
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+)
+
+// Tx queues commands which run atomically on the server with Exec: no other
+// client sees the store between two of them.
+type Tx struct {
+	client  *Client
+	watched map[string]uint64
+	cmds    []Message
+	keys    []string
+	args    bytes.Buffer
+	replies []func(io.Reader) error
+}
+
+// Multi starts a transaction on the connection of the client
+func (c *Client) Multi() *Tx {
+	return &Tx{client: c, watched: make(map[string]uint64)}
+}
+
+// Watch records the current version of keys, Exec then fails with
+// ErrTxAborted if any of them was modified or deleted in the meantime.
+func (tx *Tx) Watch(keys ...string) {
+	conn := tx.client.conn
+	for _, key := range keys {
+		try(sendMessage(conn, watchCmd))
+		try(sendBytes(conn, []byte(key)))
+		reply, err := readMessage(conn)
+		check(err)
+		switch reply {
+		case ackReply:
+			tx.watched[key], err = readUint64(conn)
+			check(err)
+		default:
+			panic(fmt.Errorf("Server error: %s", string(reply)))
+		}
+	}
+}
+
+func (tx *Tx) queue(cmd Message, key string, reply func(io.Reader) error) {
+	tx.cmds = append(tx.cmds, cmd)
+	tx.keys = append(tx.keys, key)
+	tx.replies = append(tx.replies, reply)
+}
+
+// ackReplyFunc reads the reply to a queued command
+func ackReplyFunc(conn io.Reader) error {
+	reply, err := readMessage(conn)
+	check(err)
+	switch reply {
+	case errNoKeyReply:
+		return ErrKeyNotFound
+	case errQuotaExceededReply:
+		return ErrQuotaExceeded
+	case errChecksumMismatchReply:
+		return ErrChecksumMismatch
+	case ackReply:
+		return nil
+	default:
+		panic(fmt.Errorf("Server error: %s", string(reply)))
+	}
+}
+
+// uint32ReplyFunc reads the reply to a queued command, discarding the
+// returned value
+func uint32ReplyFunc(conn io.Reader) error {
+	err := ackReplyFunc(conn)
+	if err == nil {
+		_, err := readUint32(conn)
+		check(err)
+	}
+	return err
+}
+
+// SetBytes ...
+func (tx *Tx) SetBytes(key string, data []byte) {
+	try(sendBytes(&tx.args, data))
+	tx.queue(setBytesCmd, key, ackReplyFunc)
+}
+
+// SetBytesRange ...
+func (tx *Tx) SetBytesRange(key string, start uint32, data []byte) {
+	try(sendUint32(&tx.args, start))
+	try(sendBytes(&tx.args, data))
+	tx.queue(setBytesRangeCmd, key, ackReplyFunc)
+}
+
+// AppendBytes ...
+func (tx *Tx) AppendBytes(key string, data []byte) {
+	try(sendBytes(&tx.args, data))
+	tx.queue(appendBytesCmd, key, uint32ReplyFunc)
+}
+
+// SetBytesChecked queues a SetBytesChecked, the transaction still runs the
+// other commands if the checksum does not match.
+func (tx *Tx) SetBytesChecked(key string, data []byte, crc uint32) {
+	try(sendUint32(&tx.args, crc))
+	try(sendBytes(&tx.args, data))
+	tx.queue(setBytesCheckedCmd, key, ackReplyFunc)
+}
+
+// TruncateBytes ...
+func (tx *Tx) TruncateBytes(key string, size uint32) {
+	try(sendUint32(&tx.args, size))
+	tx.queue(truncateBytesCmd, key, ackReplyFunc)
+}
+
+// DelBytes ...
+func (tx *Tx) DelBytes(key string) {
+	tx.queue(delBytesCmd, key, ackReplyFunc)
+}
+
+// SetUint ...
+func (tx *Tx) SetUint(key string, val uint32) {
+	try(sendUint32(&tx.args, val))
+	tx.queue(setUintCmd, key, ackReplyFunc)
+}
+
+// SetUintIfMax ...
+func (tx *Tx) SetUintIfMax(key string, val uint32) {
+	try(sendUint32(&tx.args, val))
+	tx.queue(setUintIfMaxCmd, key, ackReplyFunc)
+}
+
+// SetUintIfMin ...
+func (tx *Tx) SetUintIfMin(key string, val uint32) {
+	try(sendUint32(&tx.args, val))
+	tx.queue(setUintIfMinCmd, key, ackReplyFunc)
+}
+
+// AddUint ...
+func (tx *Tx) AddUint(key string, delta uint32) {
+	try(sendUint32(&tx.args, delta))
+	tx.queue(addUintCmd, key, uint32ReplyFunc)
+}
+
+// DelUint ...
+func (tx *Tx) DelUint(key string) {
+	tx.queue(delUintCmd, key, ackReplyFunc)
+}
+
+// Exec runs the queued commands and returns their errors in order, such as
+// ErrKeyNotFound for a missing key. It returns ErrTxAborted without running
+// anything if a watched key was modified, and ErrTxInvalid if a command is not
+// allowed in transactions. The transaction is empty afterwards.
+func (tx *Tx) Exec() ([]error, error) {
+	defer tx.Discard()
+	conn := tx.client.conn
+	try(sendMessage(conn, execCmd))
+	try(sendUint32(conn, uint32(len(tx.watched))))
+	for key, version := range tx.watched {
+		try(sendBytes(conn, []byte(key)))
+		try(sendUint64(conn, version))
+	}
+	try(sendUint32(conn, uint32(len(tx.cmds))))
+	for i, cmd := range tx.cmds {
+		try(sendMessage(conn, cmd))
+		try(sendBytes(conn, []byte(tx.keys[i])))
+	}
+	try(sendBytes(conn, tx.args.Bytes()))
+	reply, err := readMessage(conn)
+	check(err)
+	switch reply {
+	case errTxAbortedReply:
+		return nil, ErrTxAborted
+	case errTxInvalidReply:
+		return nil, ErrTxInvalid
+	case ackReply:
+		data, err := readBytes(conn)
+		check(err)
+		replies := bytes.NewReader(data)
+		errs := make([]error, len(tx.replies))
+		for i, readReply := range tx.replies {
+			errs[i] = readReply(replies)
+		}
+		return errs, nil
+	default:
+		panic(fmt.Errorf("Server error: %s", string(reply)))
+	}
+}
+
+// Discard drops the queued commands and the watched keys
+func (tx *Tx) Discard() {
+	tx.watched = make(map[string]uint64)
+	tx.cmds = nil
+	tx.keys = nil
+	tx.args.Reset()
+	tx.replies = nil
+}
@@ -0,0 +1,64 @@
+package kvdroid
+
+import (
+	"time"
+)
+
+// Leaser is the lock API of Client and Ring
+type Leaser interface {
+	LockWait(key string, ttl, timeout time.Duration) (uint64, error)
+	Unlock(key string, token uint64) error
+	RefreshLock(key string, token uint64, ttl time.Duration) error
+}
+
+// Mutex is a distributed lock on a key. The lock is a lease which expires
+// after ttl unless refreshed, so that a crashed holder does not block the
+// others forever.
+type Mutex struct {
+	kv    Leaser
+	key   string
+	ttl   time.Duration
+	token uint64
+}
+
+// NewMutex ...
+func NewMutex(kv Leaser, key string, ttl time.Duration) *Mutex {
+	return &Mutex{
+		kv:  kv,
+		key: key,
+		ttl: ttl,
+	}
+}
+
+// Lock blocks until it holds the lock, or returns ErrTimeout once timeout
+// expires. A zero timeout waits forever.
+func (m *Mutex) Lock(timeout time.Duration) error {
+	token, err := m.kv.LockWait(m.key, m.ttl, timeout)
+	if err != nil {
+		return err
+	}
+	m.token = token
+	return nil
+}
+
+// Unlock releases the lock. It returns ErrLockLost if the lease expired
+// and another holder took the lock.
+func (m *Mutex) Unlock() error {
+	token := m.token
+	m.token = 0
+	return m.kv.Unlock(m.key, token)
+}
+
+// Refresh extends the lease by ttl. It returns ErrLockLost if the lease
+// expired.
+func (m *Mutex) Refresh() error {
+	return m.kv.RefreshLock(m.key, m.token, m.ttl)
+}
+
+// Token returns the fencing token of the current lease. Tokens increase
+// with every lease handed out by a server, so a store protected by the
+// lock can reject the writes of a holder whose lease expired by comparing
+// tokens.
+func (m *Mutex) Token() uint64 {
+	return m.token
+}
@@ -0,0 +1,170 @@
+package kvdroid
+
+import (
+	"fmt"
+	"net"
+	"sort"
+)
+
+// DefaultNamespace is the namespace of the connections which did not
+// select another one
+const DefaultNamespace = "default"
+
+// namespace is a keyspace isolated from the other ones of the store, with
+// its own buckets
+type namespace struct {
+	name    string
+	buckets map[string]*Bucket
+	hash    *ConsistentHash
+	usage   *usage
+}
+
+func newNamespace(name string, n int, packThreshold, blockSize int, quota Quota) *namespace {
+	ns := &namespace{
+		name:    name,
+		buckets: make(map[string]*Bucket),
+		hash:    NewConsistentHash(100, nil),
+		usage:   &usage{quota: quota},
+	}
+	for i := 0; i <= n; i++ {
+		bucketName := fmt.Sprintf("%d", i)
+		ns.buckets[bucketName] = newBucket(packThreshold, blockSize, ns.usage)
+		ns.hash.Add(bucketName)
+	}
+	return ns
+}
+
+func (ns *namespace) getBucket(key string) *Bucket {
+	hash := ns.hash.Get(key)
+	return ns.buckets[hash]
+}
+
+// lockKeys write locks the buckets of keys and returns them. They are locked
+// in a fixed order, which prevents deadlocks between the commands locking
+// several buckets.
+func (ns *namespace) lockKeys(keys ...string) []*Bucket {
+	involved := make(map[string]bool)
+	for _, key := range keys {
+		involved[ns.hash.Get(key)] = true
+	}
+	names := make([]string, 0, len(involved))
+	for name := range involved {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	buckets := make([]*Bucket, len(names))
+	for i, name := range names {
+		buckets[i] = ns.buckets[name]
+		buckets[i].lock()
+	}
+	return buckets
+}
+
+// unlockBuckets unlocks the buckets locked by lockKeys
+func unlockBuckets(buckets []*Bucket) {
+	for _, bucket := range buckets {
+		bucket.unlock()
+	}
+}
+
+// flush deletes all the keys of the namespace and returns their number,
+// their deletion is notified on conn
+func (ns *namespace) flush(conn net.Conn) int {
+	var n int
+	for _, bucket := range ns.buckets {
+		bucket.lock()
+		for key := range bucket.meta {
+			notifyIn(conn, ns, EventDel, key)
+		}
+		n += bucket.flush()
+		bucket.unlock()
+	}
+	return n
+}
+
+// keyspaceChannel returns the channel of the keyspace events of key
+func (ns *namespace) keyspaceChannel(key string) string {
+	return NamespaceKeyspaceChannel(ns.name, key)
+}
+
+// namespace returns the namespace called name, creating it if needed. It
+// returns nil if the store already holds maxNamespaces namespaces.
+func (s *Store) namespace(name string) *namespace {
+	if name == "" {
+		name = DefaultNamespace
+	}
+	s.nsMtx.RLock()
+	ns, ok := s.namespaces[name]
+	s.nsMtx.RUnlock()
+	if ok {
+		return ns
+	}
+	s.nsMtx.Lock()
+	defer s.nsMtx.Unlock()
+	if ns, ok := s.namespaces[name]; ok {
+		return ns
+	}
+	if s.maxNamespaces > 0 && len(s.namespaces) >= s.maxNamespaces {
+		return nil
+	}
+	ns = newNamespace(name, s.nbuckets, s.packThreshold, s.blockSize, s.quotaOf(name))
+	s.namespaces[name] = ns
+	return ns
+}
+
+// setStorageCompression sets the compression at rest of the byte values
+// from threshold bytes, by blocks of blockSize bytes
+func (s *Store) setStorageCompression(threshold, blockSize int) {
+	s.nsMtx.Lock()
+	defer s.nsMtx.Unlock()
+	s.packThreshold = threshold
+	s.blockSize = blockSize
+	for _, ns := range s.namespaces {
+		for _, bucket := range ns.buckets {
+			bucket.lock()
+			bucket.packThreshold = threshold
+			bucket.blockSize = blockSize
+			bucket.unlock()
+		}
+	}
+}
+
+// sortedNamespaces returns the namespaces of the store sorted by name
+func (s *Store) sortedNamespaces() []*namespace {
+	s.nsMtx.RLock()
+	defer s.nsMtx.RUnlock()
+	namespaces := make([]*namespace, 0, len(s.namespaces))
+	for _, ns := range s.namespaces {
+		namespaces = append(namespaces, ns)
+	}
+	sort.Slice(namespaces, func(i, j int) bool { return namespaces[i].name < namespaces[j].name })
+	return namespaces
+}
+
+// namespaceOf returns the namespace selected by the connection
+func namespaceOf(conn net.Conn) *namespace {
+	return conn.(*serverConn).ns
+}
+
+// Select switches the connection to another namespace, which fails if it
+// does not exist and the store holds the maximum number of namespaces
+func (s *Store) Select(conn net.Conn) {
+	name, err := readString(conn)
+	check(err)
+	ns := s.namespace(name)
+	if ns == nil {
+		try(sendMessage(conn, errQuotaExceededReply))
+		return
+	}
+	conn.(*serverConn).ns = ns
+	try(sendMessage(conn, ackReply))
+}
+
+// Flush deletes all the keys of the namespace of the connection. Unlike
+// FlushAll, it needs no admin token: any client can already delete the keys
+// of its namespace with DelKeys.
+func (s *Store) Flush(conn net.Conn) {
+	n := namespaceOf(conn).flush(conn)
+	try(sendMessage(conn, ackReply))
+	try(sendUint32(conn, uint32(n)))
+}
@@ -0,0 +1,245 @@
+package kvdroid
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// EventKind is the kind of a pub/sub event
+type EventKind string
+
+const (
+	// EventPublish is a message sent with Publish
+	EventPublish EventKind = "publish"
+	// EventSet is sent when a value is set or updated as a whole
+	EventSet EventKind = "set"
+	// EventSetRange is sent when a range of a byte value is updated
+	EventSetRange EventKind = "setrange"
+	// EventTruncate is sent when a byte value is truncated
+	EventTruncate EventKind = "truncate"
+	// EventDel is sent when a value is deleted, including by a flush
+	EventDel EventKind = "del"
+)
+
+// Keys do not expire, so there are no expiry events.
+
+// keyspacePrefix is the prefix of the channels of the keyspace events
+const keyspacePrefix = "__keyspace"
+
+// KeyspaceChannel returns the channel on which the modifications of key
+// are notified. Subscribe to KeyspaceChannel("job/*") as a pattern to be
+// notified of the modifications of all the keys starting with "job/".
+func KeyspaceChannel(key string) string {
+	return keyspacePrefix + "__:" + key
+}
+
+// NamespaceKeyspaceChannel is KeyspaceChannel for the keys of a namespace
+func NamespaceKeyspaceChannel(namespace, key string) string {
+	if namespace == "" || namespace == DefaultNamespace {
+		return KeyspaceChannel(key)
+	}
+	return keyspacePrefix + "@" + namespace + "__:" + key
+}
+
+// notify records a keyspace event of the current request on conn, it is
+// called by the write commands when they modify a value
+func notify(conn net.Conn, kind EventKind, key string) {
+	notifyIn(conn, nil, kind, key)
+}
+
+// notifyIn is notify for a key of ns, or of the namespace of conn if nil.
+// Nothing is recorded when nobody is subscribed.
+func notifyIn(conn net.Conn, ns *namespace, kind EventKind, key string) {
+	if tx, ok := conn.(*txConn); ok {
+		conn = tx.Conn
+	}
+	c := conn.(*serverConn)
+	if !c.subscribers.active() {
+		return
+	}
+	if ns == nil {
+		ns = c.ns
+	}
+	c.events = append(c.events, &Event{Kind: kind, Channel: ns.keyspaceChannel(key), Key: key})
+}
+
+// Event is a pub/sub event
+type Event struct {
+	Kind    EventKind
+	Channel string
+	// Key is the modified key of a keyspace event
+	Key string `json:",omitempty"`
+	// Data is the message of a published event
+	Data []byte `json:",omitempty"`
+	// Err is set on the last event of a stream which could not be decoded
+	Err error `json:"-"`
+}
+
+// SubscribeOptions selects the channels of a subscription
+type SubscribeOptions struct {
+	// Channels are channel names
+	Channels []string
+	// Patterns are glob patterns matching channel names
+	Patterns []string
+}
+
+// subscriberBacklog is the number of events buffered for each subscriber
+// before events are dropped
+const subscriberBacklog = 1024
+
+type subscription struct {
+	channels map[string]bool
+	patterns []string
+	events   chan *Event
+}
+
+func (s *subscription) matches(channel string) bool {
+	if s.channels[channel] {
+		return true
+	}
+	for _, pattern := range s.patterns {
+		if matchGlob(pattern, channel) {
+			return true
+		}
+	}
+	return false
+}
+
+// subscribers dispatches events to the subscribed connections
+type subscribers struct {
+	// number of subscriptions, accessed atomically to skip publishing when
+	// nobody listens
+	n    int32
+	mtx  sync.Mutex
+	subs map[*subscription]struct{}
+}
+
+func newSubscribers() *subscribers {
+	return &subscribers{
+		subs: make(map[*subscription]struct{}),
+	}
+}
+
+func (s *subscribers) add(sub *subscription) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.subs[sub] = struct{}{}
+	atomic.AddInt32(&s.n, 1)
+}
+
+func (s *subscribers) remove(sub *subscription) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	delete(s.subs, sub)
+	atomic.AddInt32(&s.n, -1)
+}
+
+// active tells whether there is any subscription
+func (s *subscribers) active() bool {
+	return atomic.LoadInt32(&s.n) > 0
+}
+
+// publish sends event to the matching subscriptions and returns the number
+// of subscriptions which received it
+func (s *subscribers) publish(event *Event) uint32 {
+	if !s.active() {
+		return 0
+	}
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	n := uint32(0)
+	for sub := range s.subs {
+		if !sub.matches(event.Channel) {
+			continue
+		}
+		select {
+		case sub.events <- event:
+			n++
+		default:
+			// slow subscriber, drop the event
+		}
+	}
+	return n
+}
+
+func readStrings(conn io.Reader) ([]string, error) {
+	n, err := readUint32(conn)
+	if err != nil {
+		return nil, err
+	}
+	strs := make([]string, n)
+	for i := range strs {
+		if strs[i], err = readString(conn); err != nil {
+			return nil, err
+		}
+	}
+	return strs, nil
+}
+
+func sendStrings(conn io.Writer, strs []string) error {
+	if err := sendUint32(conn, uint32(len(strs))); err != nil {
+		return err
+	}
+	for _, str := range strs {
+		if err := sendBytes(conn, []byte(str)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Subscribe turns the connection into a stream of the events published on
+// the requested channels, until the client closes it or the server stops.
+func (s *Store) Subscribe(conn net.Conn) {
+	channels, err := readStrings(conn)
+	check(err)
+	patterns, err := readStrings(conn)
+	check(err)
+	sub := &subscription{
+		channels: make(map[string]bool),
+		patterns: patterns,
+		events:   make(chan *Event, subscriberBacklog),
+	}
+	for _, channel := range channels {
+		sub.channels[channel] = true
+	}
+	s.subscribers.add(sub)
+	defer s.subscribers.remove(sub)
+	try(sendMessage(conn, ackReply))
+
+	closed := watchClose(conn)
+	for {
+		select {
+		case event := <-sub.events:
+			data, err := json.Marshal(event)
+			check(err)
+			if sendBytes(conn, data) != nil {
+				return
+			}
+		case <-closed:
+			return
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// Publish ...
+func (s *Store) Publish(conn net.Conn) {
+	channel, err := readString(conn)
+	check(err)
+	data, err := readBytes(conn)
+	check(err)
+	if strings.HasPrefix(channel, keyspacePrefix) {
+		// keyspace channels are reserved to the server
+		try(sendMessage(conn, errReservedReply))
+		return
+	}
+	n := s.subscribers.publish(&Event{Kind: EventPublish, Channel: channel, Data: data})
+	try(sendMessage(conn, ackReply))
+	try(sendUint32(conn, n))
+}
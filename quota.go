@@ -0,0 +1,80 @@
+package kvdroid
+
+import (
+	"sync/atomic"
+)
+
+// Quota limits the content of a namespace, zero fields are unlimited
+type Quota struct {
+	// MaxBytes is the total length of the byte values
+	MaxBytes int64
+	// MaxKeys is the number of distinct keys
+	MaxKeys uint64
+}
+
+// usage tracks the content of a namespace against its quota, it is shared
+// by the buckets of the namespace and its counters are accessed atomically
+type usage struct {
+	bytes int64
+	keys  int64
+	quota Quota
+}
+
+// addBytes accounts for a change of the total length of the byte values,
+// it must be called with the write lock held
+func (b *Bucket) addBytes(n int64) {
+	b.nbytes += n
+	atomic.AddInt64(&b.usage.bytes, n)
+}
+
+// allows reports whether the quota of the namespace allows the byte value
+// of key to become size bytes long, it must be called with the lock held. A
+// size below the current one is always allowed, so a range write may pass
+// the end of its range. Writes to other buckets may run concurrently, so the
+// quota may be slightly exceeded.
+func (b *Bucket) allows(key string, size uint32) bool {
+	if !b.allowsKey(key) {
+		return false
+	}
+	quota := b.usage.quota
+	if quota.MaxBytes > 0 {
+		actualSize, _ := b.sizeOf(key)
+		growth := int64(size) - int64(actualSize)
+		if growth > 0 && atomic.LoadInt64(&b.usage.bytes)+growth > quota.MaxBytes {
+			return false
+		}
+	}
+	return true
+}
+
+// allowsKey reports whether the quota of the namespace allows a value to be
+// set on key, which creates the key if it holds no value. It must be called
+// with the lock held.
+func (b *Bucket) allowsKey(key string) bool {
+	quota := b.usage.quota
+	if _, ok := b.meta[key]; ok || quota.MaxKeys == 0 {
+		return true
+	}
+	return uint64(atomic.LoadInt64(&b.usage.keys)) < quota.MaxKeys
+}
+
+// quotaOf returns the quota of the namespace called name
+func (s *Store) quotaOf(name string) Quota {
+	if quota, ok := s.quotas[name]; ok {
+		return quota
+	}
+	return s.defaultQuota
+}
+
+// setQuotas sets the quotas of the namespaces listed in quotas, and
+// defaultQuota for the other ones. It must be called before the server
+// starts.
+func (s *Store) setQuotas(quotas map[string]Quota, defaultQuota Quota) {
+	s.nsMtx.Lock()
+	defer s.nsMtx.Unlock()
+	s.quotas = quotas
+	s.defaultQuota = defaultQuota
+	for _, ns := range s.namespaces {
+		ns.usage.quota = s.quotaOf(ns.name)
+	}
+}
@@ -0,0 +1,101 @@
+package kvdroid
+
+import (
+	"bytes"
+	"net"
+)
+
+// copyTo copies the values of key of the types in typ to dstKey in dst,
+// replacing its values of these types. The byte value is shared with dstKey
+// if move is true, as the caller deletes it from key. Both buckets must be
+// write locked.
+func (b *Bucket) copyTo(key string, dst *Bucket, dstKey string, typ ValueType, move bool) {
+	if typ&TypeBytes != 0 {
+		_, packed := b.blobs[key]
+		data, _ := b.bytesOf(key)
+		if !move && !packed {
+			data = bytes.Clone(data)
+		}
+		dst.setBytes(dstKey, data)
+	}
+	if typ&TypeUint != 0 {
+		dst.uintdata[dstKey] = b.uintdata[key]
+	}
+	if typ&TypeUint64 != 0 {
+		dst.uint64data[dstKey] = b.uint64data[key]
+	}
+	if typ&TypeInt64 != 0 {
+		dst.int64data[dstKey] = b.int64data[key]
+	}
+	if typ&^TypeBytes != 0 {
+		dst.touch(dstKey)
+	}
+}
+
+// Rename moves the values of some types of key to another key, replacing
+// its values of these types
+func (s *Store) Rename(bucket *Bucket, key string, conn net.Conn) {
+	s.copyKey(key, conn, true, false)
+}
+
+// RenameIfNotExists is Rename if the other key holds no value of these
+// types
+func (s *Store) RenameIfNotExists(bucket *Bucket, key string, conn net.Conn) {
+	s.copyKey(key, conn, true, true)
+}
+
+// Copy copies the values of some types of key to another key, replacing its
+// values of these types
+func (s *Store) Copy(bucket *Bucket, key string, conn net.Conn) {
+	s.copyKey(key, conn, false, false)
+}
+
+// copyKey copies the values of key to another key, which may be in another
+// bucket, and deletes them from key if move is true. It fails if the other
+// key holds values of the same types and exclusive is true.
+func (s *Store) copyKey(key string, conn net.Conn, move, exclusive bool) {
+	typ, err := readUint32(conn)
+	check(err)
+	dstKey, err := readString(conn)
+	check(err)
+
+	ns := namespaceOf(conn)
+	buckets := ns.lockKeys(key, dstKey)
+	defer unlockBuckets(buckets)
+	src, dst := ns.getBucket(key), ns.getBucket(dstKey)
+	found := src.typeOf(key) & ValueType(typ)
+	reply := ackReply
+	switch {
+	case found == 0:
+		reply = errNoKeyReply
+	case exclusive && dst.typeOf(dstKey)&found != 0:
+		reply = errKeyExistsReply
+	case key == dstKey:
+		// nothing to do
+	case !move && !dst.allows(dstKey, copySize(src, key, dst, dstKey, found)):
+		reply = errQuotaExceededReply
+	case move && src.typeOf(key)&^found != 0 && !dst.allowsKey(dstKey):
+		// a move adds a key only if key keeps values of other types, and the
+		// moved byte value is already accounted for in the namespace
+		reply = errQuotaExceededReply
+	default:
+		src.copyTo(key, dst, dstKey, found, move)
+		notify(conn, EventSet, dstKey)
+		if move {
+			src.del(key, found)
+			notify(conn, EventDel, key)
+		}
+	}
+	try(sendMessage(conn, reply))
+}
+
+// copySize returns the size of the byte value of dstKey once the values of
+// key of the types in typ are copied to it
+func copySize(src *Bucket, key string, dst *Bucket, dstKey string, typ ValueType) uint32 {
+	if typ&TypeBytes != 0 {
+		size, _ := src.sizeOf(key)
+		return size
+	}
+	size, _ := dst.sizeOf(dstKey)
+	return size
+}
@@ -1,7 +1,11 @@
 package kvdroid
 
 import (
+	"context"
 	"fmt"
+	"sort"
+	"sync"
+	"time"
 )
 
 // Ring ...
@@ -12,12 +16,17 @@ type Ring struct {
 
 // NewRing ...
 func NewRing(addrs []string) *Ring {
+	return NewRingWithOptions(addrs, &ClientOptions{})
+}
+
+// NewRingWithOptions ...
+func NewRingWithOptions(addrs []string, opt *ClientOptions) *Ring {
 
 	ids := make([]string, len(addrs))
 	clients := make(map[string]*Client)
 	for i, addr := range addrs {
 		ids[i] = fmt.Sprintf("%d", i)
-		clients[ids[i]] = NewClient(addr)
+		clients[ids[i]] = NewClientWithOptions(addr, opt)
 	}
 	hash := NewConsistentHash(100, nil)
 	hash.Add(ids...)
@@ -63,13 +72,13 @@ func (r *Ring) GetBytesRangeUinto(key string, start, end uint32, dst []byte) (ui
 }
 
 // SetBytes ...
-func (r *Ring) SetBytes(key string, data []byte) {
-	r.GetClient(key).SetBytes(key, data)
+func (r *Ring) SetBytes(key string, data []byte) error {
+	return r.GetClient(key).SetBytes(key, data)
 }
 
 // SetBytesRange ...
-func (r *Ring) SetBytesRange(key string, start uint32, data []byte) {
-	r.GetClient(key).SetBytesRange(key, start, data)
+func (r *Ring) SetBytesRange(key string, start uint32, data []byte) error {
+	return r.GetClient(key).SetBytesRange(key, start, data)
 }
 
 // DelBytes ...
@@ -82,9 +91,19 @@ func (r *Ring) TruncateBytes(key string, size uint32) error {
 	return r.GetClient(key).TruncateBytes(key, size)
 }
 
+// AppendBytes ...
+func (r *Ring) AppendBytes(key string, data []byte) (uint32, error) {
+	return r.GetClient(key).AppendBytes(key, data)
+}
+
+// AppendBytesReturnOffset ...
+func (r *Ring) AppendBytesReturnOffset(key string, data []byte) (uint32, error) {
+	return r.GetClient(key).AppendBytesReturnOffset(key, data)
+}
+
 // SetUint ...
-func (r *Ring) SetUint(key string, val uint32) {
-	r.GetClient(key).SetUint(key, val)
+func (r *Ring) SetUint(key string, val uint32) error {
+	return r.GetClient(key).SetUint(key, val)
 }
 
 // GetUint ...
@@ -98,6 +117,514 @@ func (r *Ring) DelUint(key string) error {
 }
 
 // SetUintIfMax ...
-func (r *Ring) SetUintIfMax(key string, val uint32) {
-	r.GetClient(key).SetUintIfMax(key, val)
+func (r *Ring) SetUintIfMax(key string, val uint32) error {
+	return r.GetClient(key).SetUintIfMax(key, val)
+}
+
+// AddUint ...
+func (r *Ring) AddUint(key string, delta uint32) (uint32, error) {
+	return r.GetClient(key).AddUint(key, delta)
+}
+
+// IncrUint ...
+func (r *Ring) IncrUint(key string) (uint32, error) {
+	return r.GetClient(key).IncrUint(key)
+}
+
+// DecrUint ...
+func (r *Ring) DecrUint(key string) (uint32, error) {
+	return r.GetClient(key).DecrUint(key)
+}
+
+// SetUintIfMin ...
+func (r *Ring) SetUintIfMin(key string, val uint32) error {
+	return r.GetClient(key).SetUintIfMin(key, val)
+}
+
+// CompareAndSwapUint ...
+func (r *Ring) CompareAndSwapUint(key string, old, val uint32) (bool, error) {
+	return r.GetClient(key).CompareAndSwapUint(key, old, val)
+}
+
+// GetAndSetUint ...
+func (r *Ring) GetAndSetUint(key string, val uint32) (uint32, error) {
+	return r.GetClient(key).GetAndSetUint(key, val)
+}
+
+// SetUint64 ...
+func (r *Ring) SetUint64(key string, val uint64) error {
+	return r.GetClient(key).SetUint64(key, val)
+}
+
+// GetUint64 ...
+func (r *Ring) GetUint64(key string) (uint64, error) {
+	return r.GetClient(key).GetUint64(key)
+}
+
+// SetUint64IfMax ...
+func (r *Ring) SetUint64IfMax(key string, val uint64) error {
+	return r.GetClient(key).SetUint64IfMax(key, val)
+}
+
+// AddUint64 ...
+func (r *Ring) AddUint64(key string, delta uint64) (uint64, error) {
+	return r.GetClient(key).AddUint64(key, delta)
+}
+
+// DelUint64 ...
+func (r *Ring) DelUint64(key string) error {
+	return r.GetClient(key).DelUint64(key)
+}
+
+// SetInt64 ...
+func (r *Ring) SetInt64(key string, val int64) error {
+	return r.GetClient(key).SetInt64(key, val)
+}
+
+// GetInt64 ...
+func (r *Ring) GetInt64(key string) (int64, error) {
+	return r.GetClient(key).GetInt64(key)
+}
+
+// SetInt64IfMax ...
+func (r *Ring) SetInt64IfMax(key string, val int64) error {
+	return r.GetClient(key).SetInt64IfMax(key, val)
+}
+
+// AddInt64 ...
+func (r *Ring) AddInt64(key string, delta int64) (int64, error) {
+	return r.GetClient(key).AddInt64(key, delta)
+}
+
+// DelInt64 ...
+func (r *Ring) DelInt64(key string) error {
+	return r.GetClient(key).DelInt64(key)
+}
+
+// Exists ...
+func (r *Ring) Exists(key string) bool {
+	return r.GetClient(key).Exists(key)
+}
+
+// Type ...
+func (r *Ring) Type(key string) (ValueType, error) {
+	return r.GetClient(key).Type(key)
+}
+
+// SizeBytes ...
+func (r *Ring) SizeBytes(key string) (uint32, error) {
+	return r.GetClient(key).SizeBytes(key)
+}
+
+// Stat ...
+func (r *Ring) Stat(key string) (*KeyStat, error) {
+	return r.GetClient(key).Stat(key)
+}
+
+// WaitUintAtLeast ...
+func (r *Ring) WaitUintAtLeast(key string, n uint32, timeout time.Duration) (uint32, error) {
+	return r.GetClient(key).WaitUintAtLeast(key, n, timeout)
+}
+
+// WaitUintAtMost ...
+func (r *Ring) WaitUintAtMost(key string, n uint32, timeout time.Duration) (uint32, error) {
+	return r.GetClient(key).WaitUintAtMost(key, n, timeout)
+}
+
+// WaitExists ...
+func (r *Ring) WaitExists(key string, timeout time.Duration) error {
+	return r.GetClient(key).WaitExists(key, timeout)
+}
+
+// groupKeys returns the keys grouped by the client of their node
+func (r *Ring) groupKeys(keys []string) map[*Client][]string {
+	groups := make(map[*Client][]string)
+	for _, key := range keys {
+		client := r.GetClient(key)
+		groups[client] = append(groups[client], key)
+	}
+	return groups
+}
+
+// UnlinkBytes ...
+func (r *Ring) UnlinkBytes(keys ...string) uint32 {
+	var n uint32
+	for client, keys := range r.groupKeys(keys) {
+		n += client.UnlinkBytes(keys...)
+	}
+	return n
+}
+
+// UnlinkUint ...
+func (r *Ring) UnlinkUint(keys ...string) uint32 {
+	var n uint32
+	for client, keys := range r.groupKeys(keys) {
+		n += client.UnlinkUint(keys...)
+	}
+	return n
+}
+
+// ringChunkSize is the length of the chunks of the byte values streamed
+// between nodes
+const ringChunkSize = 1 << 20
+
+// streamBytes copies the byte value of src on from to dst on to, by chunks
+// so that large values are never held whole by the client
+func streamBytes(from *Client, src string, to *Client, dst string) error {
+	size, err := from.SizeBytes(src)
+	if err != nil {
+		return err
+	}
+	for start := uint32(0); start == 0 || start < size; start += ringChunkSize {
+		chunk, err := from.GetBytesRange(src, start, start+ringChunkSize-1)
+		if err != nil {
+			return err
+		}
+		if start == 0 {
+			err = to.SetBytes(dst, chunk)
+		} else {
+			err = to.SetBytesRange(dst, start, chunk)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// streamRange copies the byte range [srcStart, srcEnd] of src on from to dst
+// on to at offset dstStart, by chunks, and returns the number of bytes copied
+func streamRange(from *Client, src string, srcStart, srcEnd uint32, to *Client, dst string, dstStart uint32) (uint32, error) {
+	var n uint32
+	for start := srcStart; start <= srcEnd; start += ringChunkSize {
+		end := srcEnd
+		if end-start >= ringChunkSize {
+			end = start + ringChunkSize - 1
+		}
+		chunk, err := from.GetBytesRange(src, start, end)
+		if err != nil {
+			return n, err
+		}
+		if len(chunk) == 0 {
+			break
+		}
+		if err := to.SetBytesRange(dst, dstStart+n, chunk); err != nil {
+			return n, err
+		}
+		n += uint32(len(chunk))
+		if uint32(len(chunk)) < end-start+1 {
+			// end of the value
+			break
+		}
+	}
+	return n, nil
+}
+
+func (r *Ring) copyBytes(cmd Message, src, dst string) error {
+	from, to := r.GetClient(src), r.GetClient(dst)
+	if from == to {
+		return from.copyKey(cmd, TypeBytes, src, dst)
+	}
+	if cmd == renameIfNotExistsCmd {
+		if _, err := to.SizeBytes(dst); err == nil {
+			return ErrKeyExists
+		}
+	}
+	if err := streamBytes(from, src, to, dst); err != nil {
+		return err
+	}
+	if cmd != copyCmd {
+		return from.DelBytes(src)
+	}
+	return nil
+}
+
+func (r *Ring) copyUint(cmd Message, src, dst string) error {
+	from, to := r.GetClient(src), r.GetClient(dst)
+	if from == to {
+		return from.copyKey(cmd, TypeUint, src, dst)
+	}
+	if cmd == renameIfNotExistsCmd {
+		if _, err := to.GetUint(dst); err == nil {
+			return ErrKeyExists
+		}
+	}
+	val, err := from.GetUint(src)
+	if err != nil {
+		return err
+	}
+	to.SetUint(dst, val)
+	if cmd != copyCmd {
+		return from.DelUint(src)
+	}
+	return nil
+}
+
+// RenameBytes moves the byte value of src to dst. When the keys are on
+// different nodes, the value is streamed from one to the other through the
+// ring and the keys are not modified atomically.
+func (r *Ring) RenameBytes(src, dst string) error {
+	return r.copyBytes(renameCmd, src, dst)
+}
+
+// RenameBytesIfNotExists ...
+func (r *Ring) RenameBytesIfNotExists(src, dst string) error {
+	return r.copyBytes(renameIfNotExistsCmd, src, dst)
+}
+
+// CopyBytes copies the byte value of src to dst, see RenameBytes.
+func (r *Ring) CopyBytes(src, dst string) error {
+	return r.copyBytes(copyCmd, src, dst)
+}
+
+// CopyRange copies a byte range of srcKey to dstKey. When the keys are on
+// different nodes, the range is streamed from one to the other through the
+// ring.
+func (r *Ring) CopyRange(srcKey string, srcStart, srcEnd uint32, dstKey string, dstStart uint32) (uint32, error) {
+	from, to := r.GetClient(srcKey), r.GetClient(dstKey)
+	if from == to {
+		return from.CopyRange(srcKey, srcStart, srcEnd, dstKey, dstStart)
+	}
+	if _, err := from.SizeBytes(srcKey); err != nil {
+		return 0, err
+	}
+	return streamRange(from, srcKey, srcStart, srcEnd, to, dstKey, dstStart)
+}
+
+// Concat sets the byte value of dstKey to the concatenation of the byte
+// values of srcKeys. It runs on the node of dstKey if all the keys are
+// there, otherwise the values are streamed to it through the ring and dstKey
+// is not modified atomically.
+func (r *Ring) Concat(dstKey string, srcKeys ...string) (uint32, error) {
+	to := r.GetClient(dstKey)
+	sizes := make([]uint32, len(srcKeys))
+	var size uint32
+	local := true
+	for i, srcKey := range srcKeys {
+		from := r.GetClient(srcKey)
+		local = local && from == to
+		n, err := from.SizeBytes(srcKey)
+		if err != nil {
+			return 0, err
+		}
+		sizes[i] = n
+		size += n
+	}
+	if local {
+		return to.Concat(dstKey, srcKeys...)
+	}
+
+	// the pieces are written from the last one, so that dstKey is still
+	// intact when it is one of them
+	offset := size
+	for i := len(srcKeys) - 1; i >= 0; i-- {
+		offset -= sizes[i]
+		if sizes[i] == 0 {
+			continue
+		}
+		var err error
+		if from := r.GetClient(srcKeys[i]); from == to {
+			_, err = to.CopyRange(srcKeys[i], 0, sizes[i]-1, dstKey, offset)
+		} else {
+			_, err = streamRange(from, srcKeys[i], 0, sizes[i]-1, to, dstKey, offset)
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+	if size == 0 {
+		return 0, to.SetBytes(dstKey, nil)
+	}
+	return size, to.TruncateBytes(dstKey, size)
+}
+
+// RenameUint ...
+func (r *Ring) RenameUint(src, dst string) error {
+	return r.copyUint(renameCmd, src, dst)
+}
+
+// RenameUintIfNotExists ...
+func (r *Ring) RenameUintIfNotExists(src, dst string) error {
+	return r.copyUint(renameIfNotExistsCmd, src, dst)
+}
+
+// CopyUint ...
+func (r *Ring) CopyUint(src, dst string) error {
+	return r.copyUint(copyCmd, src, dst)
+}
+
+// Select switches every node to another namespace, it stops at the first
+// error.
+func (r *Ring) Select(namespace string) error {
+	for _, client := range r.clients {
+		if err := client.Select(namespace); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Flush deletes the keys of the namespace on every node and returns the
+// number of keys deleted by node address.
+func (r *Ring) Flush() map[string]uint32 {
+	counts := make(map[string]uint32)
+	for _, client := range r.clients {
+		counts[client.addr] = client.Flush()
+	}
+	return counts
+}
+
+// DelPrefix deletes the keys starting with prefix on every node and returns
+// the number of keys deleted by node address.
+func (r *Ring) DelPrefix(prefix string) map[string]uint32 {
+	counts := make(map[string]uint32)
+	for _, client := range r.clients {
+		counts[client.addr] = client.DelPrefix(prefix)
+	}
+	return counts
+}
+
+// DelPattern deletes the keys matching pattern on every node and returns
+// the number of keys deleted by node address.
+func (r *Ring) DelPattern(pattern string) map[string]uint32 {
+	counts := make(map[string]uint32)
+	for _, client := range r.clients {
+		counts[client.addr] = client.DelPattern(pattern)
+	}
+	return counts
+}
+
+// FlushAll empties every node and returns the number of keys deleted by
+// node address. It stops at the first node which denies the token.
+func (r *Ring) FlushAll(token string) (map[string]uint32, error) {
+	counts := make(map[string]uint32)
+	for _, client := range r.clients {
+		n, err := client.FlushAll(token)
+		if err != nil {
+			return counts, err
+		}
+		counts[client.addr] = n
+	}
+	return counts, nil
+}
+
+// SetBytesChecked ...
+func (r *Ring) SetBytesChecked(key string, data []byte, crc uint32) error {
+	return r.GetClient(key).SetBytesChecked(key, data, crc)
+}
+
+// Checksum ...
+func (r *Ring) Checksum(key string, start, end uint32) (uint32, error) {
+	return r.GetClient(key).Checksum(key, start, end)
+}
+
+// GetBytesVersion ...
+func (r *Ring) GetBytesVersion(key string) ([]byte, uint64, error) {
+	return r.GetClient(key).GetBytesVersion(key)
+}
+
+// GetUintVersion ...
+func (r *Ring) GetUintVersion(key string) (uint32, uint64, error) {
+	return r.GetClient(key).GetUintVersion(key)
+}
+
+// SetBytesIfVersion ...
+func (r *Ring) SetBytesIfVersion(key string, data []byte, version uint64) (uint64, error) {
+	return r.GetClient(key).SetBytesIfVersion(key, data, version)
+}
+
+// SetBytesRangeIfVersion ...
+func (r *Ring) SetBytesRangeIfVersion(key string, start uint32, data []byte, version uint64) (uint64, error) {
+	return r.GetClient(key).SetBytesRangeIfVersion(key, start, data, version)
+}
+
+// DelIfVersion ...
+func (r *Ring) DelIfVersion(key string, version uint64) error {
+	return r.GetClient(key).DelIfVersion(key, version)
+}
+
+// Lock ...
+func (r *Ring) Lock(key string, ttl time.Duration) (uint64, error) {
+	return r.GetClient(key).Lock(key, ttl)
+}
+
+// LockWait ...
+func (r *Ring) LockWait(key string, ttl, timeout time.Duration) (uint64, error) {
+	return r.GetClient(key).LockWait(key, ttl, timeout)
+}
+
+// Unlock ...
+func (r *Ring) Unlock(key string, token uint64) error {
+	return r.GetClient(key).Unlock(key, token)
+}
+
+// RefreshLock ...
+func (r *Ring) RefreshLock(key string, token uint64, ttl time.Duration) error {
+	return r.GetClient(key).RefreshLock(key, token, ttl)
+}
+
+// Scan returns the keys of every node matching opt, sorted by key.
+func (r *Ring) Scan(opt *ScanOptions) []ScanEntry {
+	var entries []ScanEntry
+	for _, client := range r.clients {
+		cursor := uint64(0)
+		for {
+			var batch []ScanEntry
+			batch, cursor = client.Scan(cursor, opt)
+			entries = append(entries, batch...)
+			if cursor == 0 {
+				break
+			}
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Key < entries[j].Key })
+	return entries
+}
+
+// Info returns the state of all nodes, with counters summed up. The uptime
+// is the one of the most recently started node and bucket names are
+// prefixed with the node address.
+func (r *Ring) Info() *Info {
+	info := &Info{}
+	for _, client := range r.clients {
+		info.add(client.addr, client.Info())
+	}
+	return info
+}
+
+// Subscribe subscribes to every node and merges their events, since the
+// modified keys and the published channels are spread over the nodes.
+func (r *Ring) Subscribe(ctx context.Context, opt *SubscribeOptions) (<-chan Event, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	events := make(chan Event)
+	wg := sync.WaitGroup{}
+	for _, client := range r.clients {
+		nodeEvents, err := client.Subscribe(ctx, opt)
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for event := range nodeEvents {
+				select {
+				case events <- event:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		cancel()
+		close(events)
+	}()
+	return events, nil
+}
+
+// Publish sends data on channel through the node owning the channel name.
+func (r *Ring) Publish(channel string, data []byte) (uint32, error) {
+	return r.GetClient(channel).Publish(channel, data)
 }
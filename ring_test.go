@@ -0,0 +1,164 @@
+package kvdroid_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/JCapul/kvdroid"
+	"github.com/JCapul/kvdroid/util"
+)
+
+func initRing(n int) ([]*kvdroid.Server, *kvdroid.Ring) {
+	servers := make([]*kvdroid.Server, n)
+	addrs := make([]string, n)
+	for i := range servers {
+		servers[i] = kvdroid.NewServer(&kvdroid.ServerOptions{Port: -1})
+		go servers[i].Start()
+		addrs[i] = servers[i].Addr()
+	}
+	return servers, kvdroid.NewRing(addrs)
+}
+
+func shutdownRing(servers []*kvdroid.Server, ring *kvdroid.Ring) {
+	ring.Close()
+	for _, server := range servers {
+		server.Shutdown()
+	}
+}
+
+func TestRingScan(t *testing.T) {
+	servers, ring := initRing(3)
+	defer shutdownRing(servers, ring)
+
+	for i := 0; i < 30; i++ {
+		ring.SetUint(fmt.Sprintf("foo%02d", i), uint32(i))
+	}
+	ring.SetBytes("bar", []byte("bar"))
+
+	entries := ring.Scan(&kvdroid.ScanOptions{Prefix: "foo"})
+	util.Equals(t, 30, len(entries), "wrong number of keys")
+	for i, entry := range entries {
+		util.Equals(t, fmt.Sprintf("foo%02d", i), entry.Key, "keys should be sorted")
+	}
+}
+
+func TestRingDelPrefix(t *testing.T) {
+	servers, ring := initRing(3)
+	defer shutdownRing(servers, ring)
+
+	for i := 0; i < 30; i++ {
+		ring.SetUint(fmt.Sprintf("foo%02d", i), uint32(i))
+	}
+	ring.SetBytes("bar", []byte("bar"))
+
+	counts := ring.DelPrefix("foo")
+	util.Equals(t, 3, len(counts), "every node should report")
+	var total uint32
+	for _, n := range counts {
+		total += n
+	}
+	util.Equals(t, uint32(30), total, "count should match")
+	util.Equals(t, uint64(1), ring.Info().Keys, "keys should match")
+}
+
+func TestRingInfo(t *testing.T) {
+	servers, ring := initRing(3)
+	defer shutdownRing(servers, ring)
+
+	for i := 0; i < 30; i++ {
+		ring.SetBytes(fmt.Sprintf("foo%02d", i), []byte("0123456789"))
+	}
+
+	info := ring.Info()
+	util.Equals(t, uint64(30), info.Keys, "wrong number of keys")
+	util.Equals(t, int64(300), info.Bytes, "wrong number of bytes")
+	util.Equals(t, uint64(30), info.Ops["SetBytes"], "wrong number of operations")
+	util.Equals(t, int64(3), info.ConnectedClients, "wrong number of clients")
+}
+
+func TestRingSubscribe(t *testing.T) {
+	servers, ring := initRing(3)
+	defer shutdownRing(servers, ring)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events, err := ring.Subscribe(ctx, &kvdroid.SubscribeOptions{
+		Patterns: []string{kvdroid.KeyspaceChannel("foo*")},
+	})
+	util.Ok(t, err)
+
+	keys := make(map[string]bool)
+	for i := 0; i < 10; i++ {
+		key := fmt.Sprintf("foo%d", i)
+		ring.SetUint(key, uint32(i))
+		keys[key] = true
+	}
+	for range keys {
+		event := <-events
+		util.Assert(t, keys[event.Key], "unexpected event %v", event)
+		delete(keys, event.Key)
+	}
+}
+
+func TestRingRename(t *testing.T) {
+	servers, ring := initRing(3)
+	defer shutdownRing(servers, ring)
+
+	// find keys on different nodes
+	src, dst := "src", "dst0"
+	for i := 1; ring.GetClient(src) == ring.GetClient(dst); i++ {
+		dst = fmt.Sprintf("dst%d", i)
+	}
+	data := make([]byte, 5<<19)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	ring.SetBytes(src, data)
+	util.Ok(t, ring.CopyBytes(src, dst))
+	recv, err := ring.GetBytes(dst)
+	util.Ok(t, err)
+	util.Equals(t, data, recv, "value should be copied")
+
+	util.Equals(t, kvdroid.ErrKeyExists, ring.RenameBytesIfNotExists(src, dst), "should raise KeyExists error")
+	ring.DelBytes(dst)
+	util.Ok(t, ring.RenameBytesIfNotExists(src, dst))
+	_, err = ring.GetBytes(src)
+	util.Equals(t, kvdroid.ErrKeyNotFound, err, "source should be deleted")
+
+	ring.SetUint(src, 7)
+	util.Ok(t, ring.RenameUint(src, dst))
+	val, err := ring.GetUint(dst)
+	util.Ok(t, err)
+	util.Equals(t, uint32(7), val, "value should be moved")
+	util.Equals(t, kvdroid.ErrKeyNotFound, ring.CopyUint(src, dst), "should raise KeyNotFound error")
+}
+
+func TestRingConcat(t *testing.T) {
+	servers, ring := initRing(3)
+	defer shutdownRing(servers, ring)
+
+	var keys []string
+	var expected []byte
+	for i := 0; i < 10; i++ {
+		key := fmt.Sprintf("piece%d", i)
+		piece := []byte(fmt.Sprintf("<%d>", i))
+		ring.SetBytes(key, piece)
+		keys = append(keys, key)
+		expected = append(expected, piece...)
+	}
+	ring.SetBytes("array", []byte("[]"))
+	expected = append(expected, '[', ']')
+	n, err := ring.Concat("array", append(keys, "array")...)
+	util.Ok(t, err)
+	util.Equals(t, uint32(len(expected)), n, "wrong length")
+	data, err := ring.GetBytes("array")
+	util.Ok(t, err)
+	util.Equals(t, expected, data, "pieces should be concatenated")
+
+	n, err = ring.CopyRange("array", 3, 5, "piece0", 1)
+	util.Ok(t, err)
+	util.Equals(t, uint32(3), n, "wrong number of bytes copied")
+	data, _ = ring.GetBytes("piece0")
+	util.Equals(t, []byte("<<1>"), data, "range should be copied")
+}
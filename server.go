@@ -1,55 +1,312 @@
 package kvdroid
 
 import (
+	"encoding/json"
 	"fmt"
+	"hash/fnv"
 	"io"
 	"log"
 	"net"
+	"net/http"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // Bucket stores data
 type Bucket struct {
-	bytedata map[string][]byte
-	uintdata map[string]uint32
-	mtx      *sync.RWMutex
+	// number of lock acquisitions which had to wait, accessed atomically
+	contended uint64
+	// total length of the byte values
+	nbytes int64
+	// last version given to a modified key
+	version uint64
+	// version given to the last deletion, which stands for the version of
+	// the keys holding no value when they are watched
+	deleted    uint64
+	bytedata   map[string][]byte
+	uintdata   map[string]uint32
+	uint64data map[string]uint64
+	int64data  map[string]int64
+	// blobs are the byte values stored compressed
+	blobs map[string]*blob
+	// byte values from packThreshold bytes are stored compressed by
+	// blocks of blockSize bytes, 0 disables compression
+	packThreshold int
+	blockSize     int
+	// uncompressed length and stored size of the blobs
+	packedBytes int64
+	packedSize  int64
+	// number of flushes, see detached
+	flushes uint64
+	// usage of the namespace of the bucket
+	usage *usage
+	meta  map[string]*keyMeta
+	// waiters are signaled when their key is modified
+	waiters map[string]map[chan struct{}]struct{}
+	locks   map[string]*lease
+	mtx     *sync.RWMutex
+}
+
+// keyMeta holds the metadata shared by all the values of a key
+type keyMeta struct {
+	modTime time.Time
+	version uint64
+	// crc is the CRC32C of the uncompressed byte value, the blobs hold one
+	// per block
+	crc uint32
 }
 
 // Store manages requests and buckets
 type Store struct {
-	buckets  map[string]*Bucket
-	hash     *ConsistentHash
-	stopChan chan bool
+	// last fencing token handed out with a lock, accessed atomically
+	fence uint64
+	// namespaces are created on first use with nbuckets buckets, up to
+	// maxNamespaces if not 0
+	nbuckets      int
+	namespaces    map[string]*namespace
+	maxNamespaces int
+	nsMtx         sync.RWMutex
+	// options of the buckets, see Bucket.packThreshold
+	packThreshold int
+	blockSize     int
+	stopChan      chan bool
+	stats         *storeStats
+	started       time.Time
+	slowLog       *slowLog
+	monitors      *monitors
+	subscribers   *subscribers
+	// done is closed when the server stops
+	done chan struct{}
+	// compression threshold proposed to the clients, 0 if disabled
+	compressThreshold int
+	// token required by the admin commands, which are disabled if empty
+	adminToken string
+	// quotas of the namespaces, defaultQuota applies to the unlisted ones
+	quotas       map[string]Quota
+	defaultQuota Quota
+}
+
+func newBucket(packThreshold, blockSize int, u *usage) *Bucket {
+	return &Bucket{
+		usage:         u,
+		bytedata:      make(map[string][]byte),
+		blobs:         make(map[string]*blob),
+		packThreshold: packThreshold,
+		blockSize:     blockSize,
+		uintdata:      make(map[string]uint32),
+		uint64data:    make(map[string]uint64),
+		int64data:     make(map[string]int64),
+		meta:          make(map[string]*keyMeta),
+		waiters:       make(map[string]map[chan struct{}]struct{}),
+		locks:         make(map[string]*lease),
+		mtx:           &sync.RWMutex{},
+	}
 }
 
 // NewStore ...
 func NewStore(n int, stopChan chan bool) *Store {
-	hash := NewConsistentHash(100, nil)
-	buckets := make(map[string]*Bucket)
-	for i := 0; i <= n; i++ {
-		name := fmt.Sprintf("%d", i)
-		buckets[name] = &Bucket{
-			bytedata: make(map[string][]byte),
-			uintdata: make(map[string]uint32),
-			mtx:      &sync.RWMutex{},
+	s := &Store{
+		nbuckets:    n,
+		namespaces:  make(map[string]*namespace),
+		blockSize:   defaultStorageBlockSize,
+		stopChan:    stopChan,
+		stats:       &storeStats{},
+		started:     time.Now(),
+		slowLog:     newSlowLog(defaultSlowLogThreshold, defaultSlowLogLen),
+		monitors:    newMonitors(),
+		subscribers: newSubscribers(),
+		done:        make(chan struct{}),
+	}
+	s.namespace(DefaultNamespace)
+	return s
+}
+
+func (b *Bucket) lock() {
+	if !b.mtx.TryLock() {
+		atomic.AddUint64(&b.contended, 1)
+		b.mtx.Lock()
+	}
+}
+
+func (b *Bucket) unlock() {
+	b.mtx.Unlock()
+}
+
+func (b *Bucket) rlock() {
+	if !b.mtx.TryRLock() {
+		atomic.AddUint64(&b.contended, 1)
+		b.mtx.RLock()
+	}
+}
+
+func (b *Bucket) runlock() {
+	b.mtx.RUnlock()
+}
+
+// setBytes stores the byte value of key, it must be called with the write
+// lock held
+func (b *Bucket) setBytes(key string, data []byte) {
+	size, _ := b.sizeOf(key)
+	b.addBytes(int64(len(data)) - int64(size))
+	b.dropBlob(key)
+	if b.packThreshold > 0 && len(data) >= b.packThreshold {
+		delete(b.bytedata, key)
+		b.addBlob(key, newBlob(data, b.blockSize))
+		b.touch(key)
+	} else {
+		b.bytedata[key] = data
+		b.touchBytes(key)
+	}
+}
+
+// touchBytes records a modification of the uncompressed byte value of key
+// and updates its checksum, it must be called with the write lock held
+func (b *Bucket) touchBytes(key string) {
+	b.touch(key)
+	b.meta[key].crc = CRC32C(b.bytedata[key])
+}
+
+// delBytes deletes the byte value of key, it must be called with the write
+// lock held
+func (b *Bucket) delBytes(key string) {
+	size, _ := b.sizeOf(key)
+	b.addBytes(-int64(size))
+	delete(b.bytedata, key)
+	b.dropBlob(key)
+	b.forget(key)
+}
+
+// del deletes the values of key of the types in typ and reports whether
+// there was any, it must be called with the write lock held
+func (b *Bucket) del(key string, typ ValueType) bool {
+	found := b.typeOf(key) & typ
+	if found&TypeBytes != 0 {
+		b.delBytes(key)
+	}
+	if found&TypeUint != 0 {
+		delete(b.uintdata, key)
+	}
+	if found&TypeUint64 != 0 {
+		delete(b.uint64data, key)
+	}
+	if found&TypeInt64 != 0 {
+		delete(b.int64data, key)
+	}
+	if found != 0 {
+		b.forget(key)
+	}
+	return found != 0
+}
+
+// keys returns the keys holding a value of one of the types in typ, along
+// with the types they hold.
+func (b *Bucket) keys(typ ValueType) map[string]ValueType {
+	keys := make(map[string]ValueType)
+	if typ&TypeBytes != 0 {
+		for key := range b.bytedata {
+			keys[key] |= TypeBytes
+		}
+		for key := range b.blobs {
+			keys[key] |= TypeBytes
+		}
+	}
+	if typ&TypeUint != 0 {
+		for key := range b.uintdata {
+			keys[key] |= TypeUint
+		}
+	}
+	if typ&TypeUint64 != 0 {
+		for key := range b.uint64data {
+			keys[key] |= TypeUint64
+		}
+	}
+	if typ&TypeInt64 != 0 {
+		for key := range b.int64data {
+			keys[key] |= TypeInt64
 		}
-		hash.Add(name)
 	}
-	return &Store{
-		buckets:  buckets,
-		hash:     hash,
-		stopChan: stopChan,
+	return keys
+}
+
+// typeOf returns the types of the values held by key
+func (b *Bucket) typeOf(key string) ValueType {
+	var typ ValueType
+	if _, ok := b.sizeOf(key); ok {
+		typ |= TypeBytes
+	}
+	if _, ok := b.uintdata[key]; ok {
+		typ |= TypeUint
+	}
+	if _, ok := b.uint64data[key]; ok {
+		typ |= TypeUint64
+	}
+	if _, ok := b.int64data[key]; ok {
+		typ |= TypeInt64
 	}
+	return typ
 }
 
-func (s *Store) getBucket(key string) *Bucket {
-	hash := s.hash.Get(key)
-	return s.buckets[hash]
+// touch records a modification of key, it must be called with the write
+// lock held
+func (b *Bucket) touch(key string) {
+	meta, ok := b.meta[key]
+	if !ok {
+		meta = &keyMeta{}
+		b.meta[key] = meta
+		atomic.AddInt64(&b.usage.keys, 1)
+	}
+	meta.modTime = time.Now()
+	b.version++
+	meta.version = b.version
+	b.wake(key)
+}
+
+// versionOf returns the version of key, 0 if it holds no value
+func (b *Bucket) versionOf(key string) uint64 {
+	if meta, ok := b.meta[key]; ok {
+		return meta.version
+	}
+	return 0
+}
+
+// watchVersionOf returns the version of key checked by the transactions
+// watching it. A key holding no value takes the version of the last deletion
+// in the bucket, so that creating then deleting it is noticed. Deleting
+// another key of the bucket aborts the transaction as well.
+func (b *Bucket) watchVersionOf(key string) uint64 {
+	if meta, ok := b.meta[key]; ok {
+		return meta.version
+	}
+	return b.deleted
+}
+
+// forget drops the metadata of key once it holds no value anymore, it must
+// be called with the write lock held
+func (b *Bucket) forget(key string) {
+	if _, ok := b.meta[key]; ok && b.typeOf(key) == 0 {
+		delete(b.meta, key)
+		atomic.AddInt64(&b.usage.keys, -1)
+		b.version++
+		b.deleted = b.version
+	}
+	b.wake(key)
 }
 
-func (s *Store) handleRequest(conn net.Conn, wg *sync.WaitGroup) {
+// close ends the streams of the store
+func (s *Store) close() {
+	close(s.done)
+}
+
+func (s *Store) handleRequest(netConn net.Conn, wg *sync.WaitGroup) {
 	defer wg.Done()
-	defer conn.Close()
+	defer netConn.Close()
+	atomic.AddUint64(&s.stats.connections, 1)
+	atomic.AddInt64(&s.stats.clients, 1)
+	defer atomic.AddInt64(&s.stats.clients, -1)
+	conn := &serverConn{Conn: netConn, stats: s.stats, ns: s.namespace(DefaultNamespace), subscribers: s.subscribers}
 	for {
 		cmd, err := readMessage(conn)
 		if err == io.EOF {
@@ -57,46 +314,273 @@ func (s *Store) handleRequest(conn net.Conn, wg *sync.WaitGroup) {
 			return
 		}
 		check(err)
+		atomic.AddUint64(&s.stats.ops[cmd], 1)
 
-		if cmd == stopCmd {
+		// these commands end the request loop of the connection
+		switch cmd {
+		case stopCmd:
 			try(sendMessage(conn, ackReply))
-			s.stopChan <- true
+			select {
+			case s.stopChan <- true:
+			default:
+				// already stopping
+			}
+			return
+		case monitorCmd:
+			s.Monitor(conn)
+			return
+		case subscribeCmd:
+			s.Subscribe(conn)
 			return
 		}
 
-		key, err := readString(conn)
-		check(err)
+		start := time.Now()
+		conn.startRequest()
+		key := s.dispatch(cmd, conn)
+		elapsed := time.Since(start)
+		s.stats.observe(cmd, elapsed, conn.reply)
+		// the entry is only built for the slow log or the monitors
+		if slow := s.slowLog.records(elapsed); slow || s.monitors.active() {
+			entry := SlowLogEntry{
+				Time:         start,
+				Command:      cmd.String(),
+				Key:          key,
+				Duration:     elapsed,
+				RequestBytes: conn.requestBytes,
+				ReplyBytes:   conn.replyBytes,
+				ClientAddr:   conn.RemoteAddr().String(),
+				Namespace:    conn.ns.name,
+			}
+			if slow {
+				s.slowLog.add(entry)
+			}
+			s.monitors.publish(MonitorEvent{SlowLogEntry: entry})
+		}
+		// the events are published once the buckets are unlocked
+		for _, event := range conn.events {
+			s.subscribers.publish(event)
+		}
+		conn.events = conn.events[:0]
+	}
+}
 
-		bucket := s.getBucket(key)
+// lockMode tells how dispatch locks the bucket of a keyed command
+type lockMode int
 
-		switch cmd {
-		case getBytesCmd:
-			s.GetBytes(bucket, key, conn)
-		case getBytesIntoCmd:
-			s.GetBytesInto(bucket, key, conn)
-		case getBytesRangeCmd:
-			s.GetBytesRange(bucket, key, conn)
-		case getBytesRangeIntoCmd:
-			s.GetBytesRangeInto(bucket, key, conn)
-		case setBytesCmd:
-			s.SetBytes(bucket, key, conn)
-		case setBytesRangeCmd:
-			s.SetBytesRange(bucket, key, conn)
-		case delBytesCmd:
-			s.DelBytes(bucket, key, conn)
-		case truncateBytesCmd:
-			s.TruncateBytes(bucket, key, conn)
-		case setUintCmd:
-			s.SetUint(bucket, key, conn)
-		case getUintCmd:
-			s.GetUint(bucket, key, conn)
-		case delUintCmd:
-			s.DelUint(bucket, key, conn)
-		case setUintIfMaxCmd:
-			s.SetUintIfMax(bucket, key, conn)
-		default:
-			panic(fmt.Errorf("Unknown command: %s", string(cmd)))
-		}
+const (
+	readLock lockMode = iota + 1
+	writeLock
+)
+
+// lockModes lists the keyed commands which do not block, the other ones
+// lock their bucket themselves. Only the commands listed here may run in a
+// transaction, which holds the locks of its buckets, and txArgs gives their
+// arguments.
+var lockModes = map[Message]lockMode{
+	getBytesCmd:               readLock,
+	getBytesIntoCmd:           readLock,
+	getBytesRangeCmd:          readLock,
+	getBytesRangeIntoCmd:      readLock,
+	setBytesCmd:               writeLock,
+	setBytesRangeCmd:          writeLock,
+	delBytesCmd:               writeLock,
+	truncateBytesCmd:          writeLock,
+	appendBytesCmd:            writeLock,
+	setUintCmd:                writeLock,
+	getUintCmd:                readLock,
+	setUintIfMaxCmd:           writeLock,
+	delUintCmd:                writeLock,
+	addUintCmd:                writeLock,
+	setUintIfMinCmd:           writeLock,
+	compareAndSwapUintCmd:     writeLock,
+	getAndSetUintCmd:          writeLock,
+	setUint64Cmd:              writeLock,
+	getUint64Cmd:              readLock,
+	setUint64IfMaxCmd:         writeLock,
+	addUint64Cmd:              writeLock,
+	delUint64Cmd:              writeLock,
+	setInt64Cmd:               writeLock,
+	getInt64Cmd:               readLock,
+	setInt64IfMaxCmd:          writeLock,
+	addInt64Cmd:               writeLock,
+	delInt64Cmd:               writeLock,
+	existsCmd:                 readLock,
+	typeCmd:                   readLock,
+	sizeBytesCmd:              readLock,
+	statCmd:                   readLock,
+	watchCmd:                  readLock,
+	getBytesVersionCmd:        readLock,
+	getUintVersionCmd:         readLock,
+	setBytesIfVersionCmd:      writeLock,
+	setBytesRangeIfVersionCmd: writeLock,
+	delIfVersionCmd:           writeLock,
+	setBytesCheckedCmd:        writeLock,
+	checksumCmd:               readLock,
+}
+
+// dispatch processes a command and returns its key, if any
+func (s *Store) dispatch(cmd Message, conn *serverConn) string {
+	switch cmd {
+	case scanCmd:
+		s.Scan(conn)
+		return ""
+	case infoCmd:
+		s.Info(conn)
+		return ""
+	case slowLogGetCmd:
+		s.SlowLogGet(conn)
+		return ""
+	case slowLogResetCmd:
+		s.SlowLogReset(conn)
+		return ""
+	case publishCmd:
+		s.Publish(conn)
+		return ""
+	case execCmd:
+		s.Exec(conn)
+		return ""
+	case helloCmd:
+		s.Hello(conn)
+		return ""
+	case unlinkCmd:
+		s.Unlink(conn)
+		return ""
+	case delKeysCmd:
+		s.DelKeys(conn)
+		return ""
+	case flushAllCmd:
+		s.FlushAll(conn)
+		return ""
+	case selectCmd:
+		s.Select(conn)
+		return ""
+	case flushCmd:
+		s.Flush(conn)
+		return ""
+	}
+
+	key, err := readString(conn)
+	check(err)
+
+	bucket := conn.ns.getBucket(key)
+	switch lockModes[cmd] {
+	case readLock:
+		bucket.rlock()
+		defer bucket.runlock()
+	case writeLock:
+		bucket.lock()
+		defer bucket.unlock()
+	}
+	s.execute(cmd, bucket, key, conn)
+	return key
+}
+
+// execute runs a keyed command
+func (s *Store) execute(cmd Message, bucket *Bucket, key string, conn net.Conn) {
+	defer replyCorrupted(conn)
+	switch cmd {
+	case getBytesCmd:
+		s.GetBytes(bucket, key, conn)
+	case getBytesIntoCmd:
+		s.GetBytesInto(bucket, key, conn)
+	case getBytesRangeCmd:
+		s.GetBytesRange(bucket, key, conn)
+	case getBytesRangeIntoCmd:
+		s.GetBytesRangeInto(bucket, key, conn)
+	case setBytesCmd:
+		s.SetBytes(bucket, key, conn)
+	case setBytesRangeCmd:
+		s.SetBytesRange(bucket, key, conn)
+	case delBytesCmd:
+		s.DelBytes(bucket, key, conn)
+	case truncateBytesCmd:
+		s.TruncateBytes(bucket, key, conn)
+	case appendBytesCmd:
+		s.AppendBytes(bucket, key, conn)
+	case setUintCmd:
+		s.SetUint(bucket, key, conn)
+	case getUintCmd:
+		s.GetUint(bucket, key, conn)
+	case delUintCmd:
+		s.DelUint(bucket, key, conn)
+	case setUintIfMaxCmd:
+		s.SetUintIfMax(bucket, key, conn)
+	case addUintCmd:
+		s.AddUint(bucket, key, conn)
+	case setUintIfMinCmd:
+		s.SetUintIfMin(bucket, key, conn)
+	case compareAndSwapUintCmd:
+		s.CompareAndSwapUint(bucket, key, conn)
+	case getAndSetUintCmd:
+		s.GetAndSetUint(bucket, key, conn)
+	case setUint64Cmd:
+		s.SetUint64(bucket, key, conn)
+	case getUint64Cmd:
+		s.GetUint64(bucket, key, conn)
+	case setUint64IfMaxCmd:
+		s.SetUint64IfMax(bucket, key, conn)
+	case addUint64Cmd:
+		s.AddUint64(bucket, key, conn)
+	case delUint64Cmd:
+		s.DelUint64(bucket, key, conn)
+	case setInt64Cmd:
+		s.SetInt64(bucket, key, conn)
+	case getInt64Cmd:
+		s.GetInt64(bucket, key, conn)
+	case setInt64IfMaxCmd:
+		s.SetInt64IfMax(bucket, key, conn)
+	case addInt64Cmd:
+		s.AddInt64(bucket, key, conn)
+	case delInt64Cmd:
+		s.DelInt64(bucket, key, conn)
+	case existsCmd:
+		s.Exists(bucket, key, conn)
+	case typeCmd:
+		s.Type(bucket, key, conn)
+	case sizeBytesCmd:
+		s.SizeBytes(bucket, key, conn)
+	case statCmd:
+		s.Stat(bucket, key, conn)
+	case waitUintAtLeastCmd:
+		s.WaitUintAtLeast(bucket, key, conn)
+	case waitUintAtMostCmd:
+		s.WaitUintAtMost(bucket, key, conn)
+	case waitExistsCmd:
+		s.WaitExists(bucket, key, conn)
+	case renameCmd:
+		s.Rename(bucket, key, conn)
+	case renameIfNotExistsCmd:
+		s.RenameIfNotExists(bucket, key, conn)
+	case copyCmd:
+		s.Copy(bucket, key, conn)
+	case copyRangeCmd:
+		s.CopyRange(bucket, key, conn)
+	case concatCmd:
+		s.Concat(bucket, key, conn)
+	case lockCmd:
+		s.Lock(bucket, key, conn)
+	case unlockCmd:
+		s.Unlock(bucket, key, conn)
+	case refreshLockCmd:
+		s.RefreshLock(bucket, key, conn)
+	case watchCmd:
+		s.Watch(bucket, key, conn)
+	case getBytesVersionCmd:
+		s.GetBytesVersion(bucket, key, conn)
+	case getUintVersionCmd:
+		s.GetUintVersion(bucket, key, conn)
+	case setBytesIfVersionCmd:
+		s.SetBytesIfVersion(bucket, key, conn)
+	case setBytesRangeIfVersionCmd:
+		s.SetBytesRangeIfVersion(bucket, key, conn)
+	case delIfVersionCmd:
+		s.DelIfVersion(bucket, key, conn)
+	case setBytesCheckedCmd:
+		s.SetBytesChecked(bucket, key, conn)
+	case checksumCmd:
+		s.Checksum(bucket, key, conn)
+	default:
+		panic(fmt.Errorf("Unknown command: %s", string(cmd)))
 	}
 }
 
@@ -104,9 +588,7 @@ func (s *Store) handleRequest(conn net.Conn, wg *sync.WaitGroup) {
 
 // GetBytes ...
 func (s *Store) GetBytes(bucket *Bucket, key string, conn net.Conn) {
-	bucket.mtx.RLock()
-	defer bucket.mtx.RUnlock()
-	data, ok := bucket.bytedata[key]
+	data, ok := bucket.bytesOf(key)
 	if !ok {
 		try(sendMessage(conn, errNoKeyReply))
 	} else {
@@ -119,47 +601,31 @@ func (s *Store) GetBytes(bucket *Bucket, key string, conn net.Conn) {
 
 // GetBytesInto ...
 func (s *Store) GetBytesInto(bucket *Bucket, key string, conn net.Conn) {
-	bucket.mtx.RLock()
-	defer bucket.mtx.RUnlock()
 	dstSize, err := readUint32(conn)
 	check(err)
-	data, ok := bucket.bytedata[key]
+	data, ok := bucket.rangeOf(key, 0, dstSize)
 	if !ok {
 		try(sendMessage(conn, errNoKeyReply))
 	} else {
 		try(sendMessage(conn, ackReply))
-		if dstSize < uint32(len(data)) {
-			try(sendBytes(conn, data[:dstSize]))
-		} else {
-			try(sendBytes(conn, data))
-		}
+		try(sendBytes(conn, data))
 	}
 }
 
 // GetBytesRange ...
 func (s *Store) GetBytesRange(bucket *Bucket, key string, conn net.Conn) {
-	bucket.mtx.RLock()
-	defer bucket.mtx.RUnlock()
 	start, err := readUint32(conn)
 	check(err)
 	end, err := readUint32(conn)
 	check(err)
 	end++ // client API considers end to be last item including (like Redis)
-	data, ok := bucket.bytedata[key]
+	// the range is truncated to actual size
+	data, ok := bucket.rangeOf(key, start, end)
 	if !ok {
 		try(sendMessage(conn, errNoKeyReply))
 	} else {
 		try(sendMessage(conn, ackReply))
-		actualSize := uint32(len(data))
-		if start > actualSize {
-			try(sendUint32(conn, uint32(0)))
-		} else {
-			if end > actualSize {
-				// truncate range to actual size
-				end = actualSize
-			}
-			try(sendBytes(conn, data[start:end]))
-		}
+		try(sendBytes(conn, data))
 	}
 }
 
@@ -167,8 +633,6 @@ func (s *Store) GetBytesRange(bucket *Bucket, key string, conn net.Conn) {
 
 // GetBytesRangeInto ...
 func (s *Store) GetBytesRangeInto(bucket *Bucket, key string, conn net.Conn) {
-	bucket.mtx.RLock()
-	defer bucket.mtx.RUnlock()
 	start, err := readUint32(conn)
 	check(err)
 	end, err := readUint32(conn)
@@ -176,121 +640,161 @@ func (s *Store) GetBytesRangeInto(bucket *Bucket, key string, conn net.Conn) {
 	end++ // client API considers end to be last item including (like Redis)
 	dstSize, err := readUint32(conn)
 	check(err)
-	data, ok := bucket.bytedata[key]
+	if end > start && end-start > dstSize {
+		// truncate range to fit in dstSize
+		end = start + dstSize
+	}
+	// the range is truncated to actual size
+	data, ok := bucket.rangeOf(key, start, end)
 	if !ok {
 		try(sendMessage(conn, errNoKeyReply))
 	} else {
 		try(sendMessage(conn, ackReply))
-		actualSize := uint32(len(data))
-		if start > actualSize {
-			try(sendUint32(conn, uint32(0)))
-		} else {
-			if end > actualSize {
-				// truncate range to actual size
-				end = actualSize
-			}
-			if (end - start) > dstSize {
-				// truncate range to fit in dstSize
-				end = start + dstSize
-			}
-			try(sendBytes(conn, data[start:end]))
-		}
+		try(sendBytes(conn, data))
 	}
 }
 
 // SetBytes ...
 func (s *Store) SetBytes(bucket *Bucket, key string, conn net.Conn) {
-	bucket.mtx.Lock()
-	defer bucket.mtx.Unlock()
 	data, err := readBytes(conn)
 	check(err)
-	bucket.bytedata[key] = data
+	if !bucket.allows(key, uint32(len(data))) {
+		try(sendMessage(conn, errQuotaExceededReply))
+		return
+	}
+	bucket.setBytes(key, data)
+	notify(conn, EventSet, key)
 	try(sendMessage(conn, ackReply))
 }
 
 // SetBytesRange ...
 func (s *Store) SetBytesRange(bucket *Bucket, key string, conn net.Conn) {
-	bucket.mtx.Lock()
-	defer bucket.mtx.Unlock()
+	s.setBytesRange(bucket, key, conn)
+}
+
+// setBytesRange writes a byte range and reports whether it was allowed by
+// the quota of the namespace
+func (s *Store) setBytesRange(bucket *Bucket, key string, conn net.Conn) bool {
 	start, err := readUint32(conn)
 	check(err)
-	newSize, err := readUint32(conn)
+	newSize, payload, err := readPayload(conn)
 	check(err)
+	if !bucket.allows(key, start+newSize) {
+		_, err = io.CopyN(io.Discard, payload, int64(newSize))
+		check(err)
+		try(sendMessage(conn, errQuotaExceededReply))
+		return false
+	}
+	if v, ok := bucket.blobs[key]; ok {
+		data := make([]byte, newSize)
+		try(readFillBuf(payload, data))
+		bucket.updateBlob(key, v, func(v *blob) { v.writeAt(data, int(start)) })
+		notify(conn, EventSetRange, key)
+		try(sendMessage(conn, ackReply))
+		return true
+	}
 	actualData, ok := bucket.bytedata[key]
 	if !ok {
 		buf := make([]byte, start+newSize, start+newSize)
-		try(readFillBuf(conn, buf[start:start+newSize]))
-		bucket.bytedata[key] = buf
+		try(readFillBuf(payload, buf[start:start+newSize]))
+		bucket.setBytes(key, buf)
 		try(sendMessage(conn, ackReply))
 	} else {
 		actualSize := uint32(len(actualData))
 		if start+newSize <= actualSize {
 			// range is within existing array
-			try(readFillBuf(conn, actualData[start:start+newSize]))
+			try(readFillBuf(payload, actualData[start:start+newSize]))
+			bucket.touchBytes(key)
 		} else {
 			// range is beyond existing array
 			if start < actualSize {
 				// range start within existing array
-				try(readFillBuf(conn, actualData[start:actualSize]))
+				try(readFillBuf(payload, actualData[start:actualSize]))
 				newSize = newSize - (actualSize - start)
 				start = actualSize
 			}
 			// get and append extended array
 			extendSize := start + newSize - actualSize
 			extendData := make([]byte, extendSize, extendSize)
-			try(readFillBuf(conn, extendData[extendSize-newSize:extendSize]))
-			bucket.bytedata[key] = append(actualData, extendData...)
+			try(readFillBuf(payload, extendData[extendSize-newSize:extendSize]))
+			bucket.setBytes(key, append(actualData, extendData...))
 		}
 		try(sendMessage(conn, ackReply))
 	}
+	notify(conn, EventSetRange, key)
+	return true
 }
 
 // DelBytes ...
 func (s *Store) DelBytes(bucket *Bucket, key string, conn net.Conn) {
-	bucket.mtx.Lock()
-	defer bucket.mtx.Unlock()
-	_, ok := bucket.bytedata[key]
+	_, ok := bucket.sizeOf(key)
 	if !ok {
 		try(sendMessage(conn, errNoKeyReply))
 	} else {
-		delete(bucket.bytedata, key)
+		bucket.delBytes(key)
+		notify(conn, EventDel, key)
 		try(sendMessage(conn, ackReply))
 	}
 }
 
-//FIXME: add an unlink command similar to Redis unlink (delete in goroutine)
-
 // TruncateBytes ...
 func (s *Store) TruncateBytes(bucket *Bucket, key string, conn net.Conn) {
-	bucket.mtx.Lock()
-	defer bucket.mtx.Unlock()
 	size, err := readUint32(conn)
 	check(err)
-	data, ok := bucket.bytedata[key]
+	actualSize, ok := bucket.sizeOf(key)
 	if !ok {
 		try(sendMessage(conn, errNoKeyReply))
 	} else {
 		try(sendMessage(conn, ackReply))
-		if size < uint32(len(data)) {
-			bucket.bytedata[key] = data[:size]
+		if size < actualSize {
+			if v, ok := bucket.blobs[key]; ok {
+				bucket.updateBlob(key, v, func(v *blob) { v.resize(int(size)) })
+			} else {
+				bucket.setBytes(key, bucket.bytedata[key][:size])
+			}
+			notify(conn, EventTruncate, key)
 		}
 	}
 }
 
+// AppendBytes ...
+func (s *Store) AppendBytes(bucket *Bucket, key string, conn net.Conn) {
+	data, err := readBytes(conn)
+	check(err)
+	if size, _ := bucket.sizeOf(key); !bucket.allows(key, size+uint32(len(data))) {
+		try(sendMessage(conn, errQuotaExceededReply))
+		return
+	}
+	if v, ok := bucket.blobs[key]; ok {
+		bucket.updateBlob(key, v, func(v *blob) { v.writeAt(data, v.size) })
+		notify(conn, EventSetRange, key)
+		try(sendMessage(conn, ackReply))
+		try(sendUint32(conn, uint32(v.size)))
+		return
+	}
+	newData := append(bucket.bytedata[key], data...)
+	bucket.setBytes(key, newData)
+	notify(conn, EventSetRange, key)
+	try(sendMessage(conn, ackReply))
+	try(sendUint32(conn, uint32(len(newData))))
+}
+
 // SetUint ...
 func (s *Store) SetUint(bucket *Bucket, key string, conn net.Conn) {
-	bucket.mtx.Lock()
-	defer bucket.mtx.Unlock()
 	val, err := readUint32(conn)
 	check(err)
+	if !bucket.allowsKey(key) {
+		try(sendMessage(conn, errQuotaExceededReply))
+		return
+	}
 	bucket.uintdata[key] = val
+	bucket.touch(key)
+	notify(conn, EventSet, key)
 	try(sendMessage(conn, ackReply))
 }
 
 // GetUint ...
 func (s *Store) GetUint(bucket *Bucket, key string, conn net.Conn) {
-	bucket.mtx.RLock()
-	defer bucket.mtx.RUnlock()
 	val, ok := bucket.uintdata[key]
 	if !ok {
 		try(sendMessage(conn, errNoKeyReply))
@@ -302,16 +806,22 @@ func (s *Store) GetUint(bucket *Bucket, key string, conn net.Conn) {
 
 // SetUintIfMax ...
 func (s *Store) SetUintIfMax(bucket *Bucket, key string, conn net.Conn) {
-	bucket.mtx.Lock()
-	defer bucket.mtx.Unlock()
 	val, err := readUint32(conn)
 	check(err)
+	if !bucket.allowsKey(key) {
+		try(sendMessage(conn, errQuotaExceededReply))
+		return
+	}
 	actualVal, ok := bucket.uintdata[key]
 	if !ok {
 		bucket.uintdata[key] = val
+		bucket.touch(key)
+		notify(conn, EventSet, key)
 	} else {
 		if val > actualVal {
 			bucket.uintdata[key] = val
+			bucket.touch(key)
+			notify(conn, EventSet, key)
 		}
 	}
 	try(sendMessage(conn, ackReply))
@@ -319,17 +829,421 @@ func (s *Store) SetUintIfMax(bucket *Bucket, key string, conn net.Conn) {
 
 // DelUint ...
 func (s *Store) DelUint(bucket *Bucket, key string, conn net.Conn) {
-	bucket.mtx.Lock()
-	defer bucket.mtx.Unlock()
 	_, ok := bucket.uintdata[key]
 	if !ok {
 		try(sendMessage(conn, errNoKeyReply))
 	} else {
 		delete(bucket.uintdata, key)
+		bucket.forget(key)
+		notify(conn, EventDel, key)
+		try(sendMessage(conn, ackReply))
+	}
+}
+
+// AddUint ...
+func (s *Store) AddUint(bucket *Bucket, key string, conn net.Conn) {
+	delta, err := readUint32(conn)
+	check(err)
+	if !bucket.allowsKey(key) {
+		try(sendMessage(conn, errQuotaExceededReply))
+		return
+	}
+	// a missing key counts as 0, uint32 arithmetic wraps around
+	val := bucket.uintdata[key] + delta
+	bucket.uintdata[key] = val
+	bucket.touch(key)
+	notify(conn, EventSet, key)
+	try(sendMessage(conn, ackReply))
+	try(sendUint32(conn, val))
+}
+
+// SetUintIfMin ...
+func (s *Store) SetUintIfMin(bucket *Bucket, key string, conn net.Conn) {
+	val, err := readUint32(conn)
+	check(err)
+	if !bucket.allowsKey(key) {
+		try(sendMessage(conn, errQuotaExceededReply))
+		return
+	}
+	actualVal, ok := bucket.uintdata[key]
+	if !ok {
+		bucket.uintdata[key] = val
+		bucket.touch(key)
+		notify(conn, EventSet, key)
+	} else {
+		if val < actualVal {
+			bucket.uintdata[key] = val
+			bucket.touch(key)
+			notify(conn, EventSet, key)
+		}
+	}
+	try(sendMessage(conn, ackReply))
+}
+
+// CompareAndSwapUint ...
+func (s *Store) CompareAndSwapUint(bucket *Bucket, key string, conn net.Conn) {
+	old, err := readUint32(conn)
+	check(err)
+	val, err := readUint32(conn)
+	check(err)
+	// a missing key is not created, so the key quota does not apply
+	actualVal, ok := bucket.uintdata[key]
+	if !ok {
+		try(sendMessage(conn, errNoKeyReply))
+	} else {
+		swapped := actualVal == old
+		if swapped {
+			bucket.uintdata[key] = val
+			bucket.touch(key)
+			notify(conn, EventSet, key)
+		}
 		try(sendMessage(conn, ackReply))
+		try(sendBool(conn, swapped))
 	}
 }
 
+// GetAndSetUint ...
+func (s *Store) GetAndSetUint(bucket *Bucket, key string, conn net.Conn) {
+	val, err := readUint32(conn)
+	check(err)
+	if !bucket.allowsKey(key) {
+		try(sendMessage(conn, errQuotaExceededReply))
+		return
+	}
+	actualVal, ok := bucket.uintdata[key]
+	bucket.uintdata[key] = val
+	bucket.touch(key)
+	notify(conn, EventSet, key)
+	if !ok {
+		try(sendMessage(conn, errNoKeyReply))
+	} else {
+		try(sendMessage(conn, ackReply))
+		try(sendUint32(conn, actualVal))
+	}
+}
+
+// SetUint64 ...
+func (s *Store) SetUint64(bucket *Bucket, key string, conn net.Conn) {
+	val, err := readUint64(conn)
+	check(err)
+	if !bucket.allowsKey(key) {
+		try(sendMessage(conn, errQuotaExceededReply))
+		return
+	}
+	bucket.uint64data[key] = val
+	bucket.touch(key)
+	notify(conn, EventSet, key)
+	try(sendMessage(conn, ackReply))
+}
+
+// GetUint64 ...
+func (s *Store) GetUint64(bucket *Bucket, key string, conn net.Conn) {
+	val, ok := bucket.uint64data[key]
+	if !ok {
+		try(sendMessage(conn, errNoKeyReply))
+	} else {
+		try(sendMessage(conn, ackReply))
+		try(sendUint64(conn, val))
+	}
+}
+
+// SetUint64IfMax ...
+func (s *Store) SetUint64IfMax(bucket *Bucket, key string, conn net.Conn) {
+	val, err := readUint64(conn)
+	check(err)
+	if !bucket.allowsKey(key) {
+		try(sendMessage(conn, errQuotaExceededReply))
+		return
+	}
+	actualVal, ok := bucket.uint64data[key]
+	if !ok || val > actualVal {
+		bucket.uint64data[key] = val
+		bucket.touch(key)
+		notify(conn, EventSet, key)
+	}
+	try(sendMessage(conn, ackReply))
+}
+
+// AddUint64 ...
+func (s *Store) AddUint64(bucket *Bucket, key string, conn net.Conn) {
+	delta, err := readUint64(conn)
+	check(err)
+	if !bucket.allowsKey(key) {
+		try(sendMessage(conn, errQuotaExceededReply))
+		return
+	}
+	val := bucket.uint64data[key] + delta
+	bucket.uint64data[key] = val
+	bucket.touch(key)
+	notify(conn, EventSet, key)
+	try(sendMessage(conn, ackReply))
+	try(sendUint64(conn, val))
+}
+
+// DelUint64 ...
+func (s *Store) DelUint64(bucket *Bucket, key string, conn net.Conn) {
+	_, ok := bucket.uint64data[key]
+	if !ok {
+		try(sendMessage(conn, errNoKeyReply))
+	} else {
+		delete(bucket.uint64data, key)
+		bucket.forget(key)
+		notify(conn, EventDel, key)
+		try(sendMessage(conn, ackReply))
+	}
+}
+
+// SetInt64 ...
+func (s *Store) SetInt64(bucket *Bucket, key string, conn net.Conn) {
+	val, err := readInt64(conn)
+	check(err)
+	if !bucket.allowsKey(key) {
+		try(sendMessage(conn, errQuotaExceededReply))
+		return
+	}
+	bucket.int64data[key] = val
+	bucket.touch(key)
+	notify(conn, EventSet, key)
+	try(sendMessage(conn, ackReply))
+}
+
+// GetInt64 ...
+func (s *Store) GetInt64(bucket *Bucket, key string, conn net.Conn) {
+	val, ok := bucket.int64data[key]
+	if !ok {
+		try(sendMessage(conn, errNoKeyReply))
+	} else {
+		try(sendMessage(conn, ackReply))
+		try(sendInt64(conn, val))
+	}
+}
+
+// SetInt64IfMax ...
+func (s *Store) SetInt64IfMax(bucket *Bucket, key string, conn net.Conn) {
+	val, err := readInt64(conn)
+	check(err)
+	if !bucket.allowsKey(key) {
+		try(sendMessage(conn, errQuotaExceededReply))
+		return
+	}
+	actualVal, ok := bucket.int64data[key]
+	if !ok || val > actualVal {
+		bucket.int64data[key] = val
+		bucket.touch(key)
+		notify(conn, EventSet, key)
+	}
+	try(sendMessage(conn, ackReply))
+}
+
+// AddInt64 ...
+func (s *Store) AddInt64(bucket *Bucket, key string, conn net.Conn) {
+	delta, err := readInt64(conn)
+	check(err)
+	if !bucket.allowsKey(key) {
+		try(sendMessage(conn, errQuotaExceededReply))
+		return
+	}
+	val := bucket.int64data[key] + delta
+	bucket.int64data[key] = val
+	bucket.touch(key)
+	notify(conn, EventSet, key)
+	try(sendMessage(conn, ackReply))
+	try(sendInt64(conn, val))
+}
+
+// DelInt64 ...
+func (s *Store) DelInt64(bucket *Bucket, key string, conn net.Conn) {
+	_, ok := bucket.int64data[key]
+	if !ok {
+		try(sendMessage(conn, errNoKeyReply))
+	} else {
+		delete(bucket.int64data, key)
+		bucket.forget(key)
+		notify(conn, EventDel, key)
+		try(sendMessage(conn, ackReply))
+	}
+}
+
+// Exists ...
+func (s *Store) Exists(bucket *Bucket, key string, conn net.Conn) {
+	try(sendMessage(conn, ackReply))
+	try(sendBool(conn, bucket.typeOf(key) != 0))
+}
+
+// Type ...
+func (s *Store) Type(bucket *Bucket, key string, conn net.Conn) {
+	typ := bucket.typeOf(key)
+	if typ == 0 {
+		try(sendMessage(conn, errNoKeyReply))
+	} else {
+		try(sendMessage(conn, ackReply))
+		try(sendUint32(conn, uint32(typ)))
+	}
+}
+
+// SizeBytes ...
+func (s *Store) SizeBytes(bucket *Bucket, key string, conn net.Conn) {
+	size, ok := bucket.sizeOf(key)
+	if !ok {
+		try(sendMessage(conn, errNoKeyReply))
+	} else {
+		try(sendMessage(conn, ackReply))
+		try(sendUint32(conn, size))
+	}
+}
+
+// Stat ...
+func (s *Store) Stat(bucket *Bucket, key string, conn net.Conn) {
+	meta, ok := bucket.meta[key]
+	if !ok {
+		try(sendMessage(conn, errNoKeyReply))
+	} else {
+		try(sendMessage(conn, ackReply))
+		try(sendUint32(conn, uint32(bucket.typeOf(key))))
+		size, _ := bucket.sizeOf(key)
+		try(sendUint32(conn, size))
+		try(sendInt64(conn, meta.modTime.UnixNano()))
+	}
+}
+
+// Scan ...
+func (s *Store) Scan(conn net.Conn) {
+	cursor, err := readUint64(conn)
+	check(err)
+	prefix, err := readString(conn)
+	check(err)
+	match, err := readString(conn)
+	check(err)
+	typ, err := readUint32(conn)
+	check(err)
+	count, err := readUint32(conn)
+	check(err)
+
+	// the cursor holds the bucket index in its upper half and, in its lower
+	// half, the hash from which to resume in the bucket keys ordered by
+	// hash. Unlike a position, the hash of the keys does not change when
+	// other keys are set or deleted.
+	idx, from := int(cursor>>32), uint32(cursor)
+	ns := namespaceOf(conn)
+	var entries []ScanEntry
+	for ; idx < len(ns.buckets) && uint32(len(entries)) < count; idx++ {
+		bucket := ns.buckets[fmt.Sprintf("%d", idx)]
+		bucket.rlock()
+		keys := bucket.keys(ValueType(typ))
+		bucket.runlock()
+
+		sorted := make([]string, 0, len(keys))
+		hashes := make(map[string]uint32, len(keys))
+		for key := range keys {
+			sorted = append(sorted, key)
+			hashes[key] = scanHash(key)
+		}
+		sort.Slice(sorted, func(i, j int) bool {
+			hi, hj := hashes[sorted[i]], hashes[sorted[j]]
+			return hi < hj || hi == hj && sorted[i] < sorted[j]
+		})
+
+		pos := sort.Search(len(sorted), func(i int) bool { return hashes[sorted[i]] >= from })
+		for ; pos < len(sorted); pos++ {
+			key := sorted[pos]
+			// the keys sharing a hash are returned together, as the
+			// cursor cannot tell them apart
+			if uint32(len(entries)) >= count && hashes[key] != hashes[sorted[pos-1]] {
+				break
+			}
+			if !strings.HasPrefix(key, prefix) {
+				continue
+			}
+			if match != "" && !matchGlob(match, key) {
+				continue
+			}
+			entries = append(entries, ScanEntry{Key: key, Type: keys[key]})
+		}
+		if pos < len(sorted) {
+			from = hashes[sorted[pos]]
+			break
+		}
+		from = 0
+	}
+
+	next := uint64(0)
+	if idx < len(ns.buckets) {
+		next = uint64(idx)<<32 | uint64(from)
+	}
+	try(sendMessage(conn, ackReply))
+	try(sendUint64(conn, next))
+	try(sendUint32(conn, uint32(len(entries))))
+	for _, entry := range entries {
+		try(sendBytes(conn, []byte(entry.Key)))
+		try(sendUint32(conn, uint32(entry.Type)))
+	}
+}
+
+// scanHash orders the keys of a bucket for Scan
+func scanHash(key string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return h.Sum32()
+}
+
+func (s *Store) info() *Info {
+	info := &Info{
+		Uptime:           time.Since(s.started),
+		ConnectedClients: atomic.LoadInt64(&s.stats.clients),
+		TotalConnections: atomic.LoadUint64(&s.stats.connections),
+		BytesIn:          atomic.LoadUint64(&s.stats.bytesIn),
+		BytesOut:         atomic.LoadUint64(&s.stats.bytesOut),
+		Ops:              make(map[string]uint64),
+		Namespaces:       make(map[string]NamespaceInfo),
+	}
+	for i := range s.stats.ops {
+		if n := atomic.LoadUint64(&s.stats.ops[i]); n > 0 {
+			info.Ops[Message(i).String()] = n
+		}
+	}
+	for _, ns := range s.sortedNamespaces() {
+		nsInfo := NamespaceInfo{
+			MaxBytes: ns.usage.quota.MaxBytes,
+			MaxKeys:  ns.usage.quota.MaxKeys,
+		}
+		for i := 0; i < len(ns.buckets); i++ {
+			name := fmt.Sprintf("%d", i)
+			bucket := ns.buckets[name]
+			if ns.name != DefaultNamespace {
+				name = ns.name + "/" + name
+			}
+			// the stats are not counted as lock contention
+			bucket.mtx.RLock()
+			bucketInfo := BucketInfo{
+				Name:            name,
+				Keys:            uint64(len(bucket.meta)),
+				Bytes:           bucket.nbytes,
+				Contended:       atomic.LoadUint64(&bucket.contended),
+				CompressedBytes: bucket.packedBytes,
+				CompressedSize:  bucket.packedSize,
+			}
+			bucket.mtx.RUnlock()
+			info.Keys += bucketInfo.Keys
+			info.Bytes += bucketInfo.Bytes
+			info.CompressedBytes += bucketInfo.CompressedBytes
+			info.CompressedSize += bucketInfo.CompressedSize
+			nsInfo.Keys += bucketInfo.Keys
+			nsInfo.Bytes += bucketInfo.Bytes
+			info.Buckets = append(info.Buckets, bucketInfo)
+		}
+		info.Namespaces[ns.name] = nsInfo
+	}
+	return info
+}
+
+// Info ...
+func (s *Store) Info(conn net.Conn) {
+	data, err := json.Marshal(s.info())
+	check(err)
+	try(sendMessage(conn, ackReply))
+	try(sendBytes(conn, data))
+}
+
 // Server ...
 type Server struct {
 	opt      *ServerOptions
@@ -337,6 +1251,10 @@ type Server struct {
 	listener net.Listener
 	store    *Store
 	stop     chan bool
+	metrics  *httpServer
+	admin    *httpServer
+	// ready is set while the server accepts connections, accessed atomically
+	ready int32
 }
 
 // ServerOptions ...
@@ -344,6 +1262,38 @@ type ServerOptions struct {
 	Bind    string
 	Port    int
 	Buckets int
+	// MetricsAddr is the address of the Prometheus metrics HTTP endpoint,
+	// disabled if empty
+	MetricsAddr string
+	// AdminAddr is the address of the HTTP endpoint serving /healthz,
+	// /readyz, /debug/pprof and /debug/vars, disabled if empty
+	AdminAddr string
+	// SlowLogThreshold is the duration above which commands are recorded
+	// in the slow log, -1 disables the slow log
+	SlowLogThreshold time.Duration
+	// SlowLogLen is the number of entries kept in the slow log, a
+	// negative length disables the slow log
+	SlowLogLen int
+	// CompressionThreshold is the size from which byte payloads are
+	// compressed on the connections of clients which enable compression,
+	// 0 disables compression
+	CompressionThreshold int
+	// StorageCompressionThreshold is the size from which byte values are
+	// stored compressed, 0 disables compression at rest
+	StorageCompressionThreshold int
+	// StorageBlockSize is the size of the blocks compressed independently
+	// in a byte value, ranges only decompress the blocks they overlap
+	StorageBlockSize int
+	// AdminToken is required by the admin commands such as FlushAll, which
+	// are disabled if empty
+	AdminToken string
+	// Quotas limits the content of the listed namespaces, and DefaultQuota
+	// the one of the other namespaces
+	Quotas       map[string]Quota
+	DefaultQuota Quota
+	// MaxNamespaces is the maximum number of namespaces, including the
+	// default one, Select fails once it is reached. 0 means no limit.
+	MaxNamespaces int
 }
 
 func (o *ServerOptions) normalize() {
@@ -365,6 +1315,15 @@ func (o *ServerOptions) normalize() {
 	if o.Buckets == 0 {
 		o.Buckets = 20
 	}
+	if o.SlowLogThreshold == 0 {
+		o.SlowLogThreshold = defaultSlowLogThreshold
+	}
+	if o.SlowLogLen == 0 {
+		o.SlowLogLen = defaultSlowLogLen
+	}
+	if o.StorageBlockSize == 0 {
+		o.StorageBlockSize = defaultStorageBlockSize
+	}
 }
 
 // NewServer ...
@@ -374,48 +1333,101 @@ func NewServer(opt *ServerOptions) *Server {
 	l, err := net.Listen("tcp", addr)
 	check(err)
 	stopChan := make(chan bool, 1)
-	return &Server{
+	server := &Server{
 		opt:      opt,
 		addr:     l.Addr().String(),
 		listener: l,
 		store:    NewStore(opt.Buckets, stopChan),
 		stop:     stopChan,
 	}
+	server.store.slowLog = newSlowLog(opt.SlowLogThreshold, opt.SlowLogLen)
+	server.store.compressThreshold = opt.CompressionThreshold
+	server.store.adminToken = opt.AdminToken
+	server.store.setStorageCompression(opt.StorageCompressionThreshold, opt.StorageBlockSize)
+	server.store.setQuotas(opt.Quotas, opt.DefaultQuota)
+	server.store.maxNamespaces = opt.MaxNamespaces
+	if opt.MetricsAddr != "" {
+		mux := http.NewServeMux()
+		mux.HandleFunc("/metrics", server.store.serveMetrics)
+		server.metrics = newHTTPServer(opt.MetricsAddr, mux)
+	}
+	if opt.AdminAddr != "" {
+		server.admin = newHTTPServer(opt.AdminAddr, server.adminHandler())
+	}
+	return server
 }
 
 // Start ...
 func (s *Server) Start() {
 	log.Printf("kvdroid: start listening on %s", s.addr)
 	wg := sync.WaitGroup{}
+	if s.metrics != nil {
+		log.Printf("kvdroid: serving metrics on %s", s.metrics.addr)
+		go s.metrics.serve()
+		defer s.metrics.close()
+	}
+	if s.admin != nil {
+		log.Printf("kvdroid: serving admin endpoint on %s", s.admin.addr)
+		go s.admin.serve()
+		defer s.admin.close()
+	}
+	// stop requests come from Shutdown or from a client, closing the
+	// listener unblocks Accept
+	stopped := make(chan struct{})
+	go func() {
+		<-s.stop
+		atomic.StoreInt32(&s.ready, 0)
+		close(stopped)
+		s.listener.Close()
+	}()
+	atomic.StoreInt32(&s.ready, 1)
+	go s.store.sweepLeases(leaseSweepInterval)
 
-loop:
 	for {
 		conn, err := s.listener.Accept()
 		if err != nil {
 			select {
-			case <-s.stop:
-				break loop
+			case <-stopped:
 			default:
 				panic(err)
 			}
+			break
 		}
 		wg.Add(1)
 		go s.store.handleRequest(conn, &wg)
-		if <-s.stop {
-			break loop
-		}
 	}
+	s.store.close()
 	wg.Wait()
 	log.Print("kvdroid: stop listening")
 }
 
 // Addr ...
-func (s Server) Addr() string {
+func (s *Server) Addr() string {
 	return s.addr
 }
 
+// MetricsAddr returns the address of the metrics endpoint, if enabled
+func (s *Server) MetricsAddr() string {
+	if s.metrics == nil {
+		return ""
+	}
+	return s.metrics.addr
+}
+
+// AdminAddr returns the address of the admin endpoint, if enabled
+func (s *Server) AdminAddr() string {
+	if s.admin == nil {
+		return ""
+	}
+	return s.admin.addr
+}
+
 // Shutdown ...
 func (s *Server) Shutdown() {
-	s.stop <- true
-	s.listener.Close()
+	atomic.StoreInt32(&s.ready, 0)
+	select {
+	case s.stop <- true:
+	default:
+		// already stopping
+	}
 }
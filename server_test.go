@@ -1,10 +1,14 @@
 package kvdroid_test
 
 import (
+	"io"
+	"net/http"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/JCapul/kvdroid"
+	"github.com/JCapul/kvdroid/util"
 )
 
 func TestStartShutdown(t *testing.T) {
@@ -13,3 +17,108 @@ func TestStartShutdown(t *testing.T) {
 	time.Sleep(1 * time.Second)
 	server.Shutdown()
 }
+
+func TestMetrics(t *testing.T) {
+	server := kvdroid.NewServer(&kvdroid.ServerOptions{Port: -1, MetricsAddr: "127.0.0.1:0"})
+	go server.Start()
+	defer server.Shutdown()
+
+	client := kvdroid.NewClient(server.Addr())
+	defer client.Close()
+	client.SetBytes("foo", []byte("0123456789"))
+	client.GetBytes("bar")
+
+	_, body := httpGet(t, "http://"+server.MetricsAddr()+"/metrics")
+
+	for _, line := range []string{
+		"kvdroid_keys 1",
+		"kvdroid_stored_bytes 10",
+		"kvdroid_connected_clients 1",
+		`kvdroid_requests_total{command="SetBytes"} 1`,
+		`kvdroid_errors_total{command="GetBytes"} 1`,
+		`kvdroid_request_duration_seconds_count{command="GetBytes"} 1`,
+	} {
+		util.Assert(t, strings.Contains(body, line+"\n"), "missing metric %q", line)
+	}
+}
+
+func httpGet(t *testing.T, url string) (int, string) {
+	resp, err := http.Get(url)
+	util.Ok(t, err)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	util.Ok(t, err)
+	return resp.StatusCode, string(body)
+}
+
+func TestAdmin(t *testing.T) {
+	server := kvdroid.NewServer(&kvdroid.ServerOptions{Port: -1, AdminAddr: "127.0.0.1:0"})
+	go server.Start()
+	defer server.Shutdown()
+	url := "http://" + server.AdminAddr()
+
+	code, _ := httpGet(t, url+"/healthz")
+	util.Equals(t, http.StatusOK, code, "server should be live")
+
+	for i := 0; i < 100; i++ {
+		if code, _ = httpGet(t, url+"/readyz"); code == http.StatusOK {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	util.Equals(t, http.StatusOK, code, "server should be ready")
+
+	code, body := httpGet(t, url+"/debug/vars")
+	util.Equals(t, http.StatusOK, code, "vars should be served")
+	util.Assert(t, strings.Contains(body, `"kvdroid": {`), "missing kvdroid vars")
+
+	code, _ = httpGet(t, url+"/debug/pprof/")
+	util.Equals(t, http.StatusOK, code, "profiles should be served")
+}
+
+func TestSlowLog(t *testing.T) {
+	server := kvdroid.NewServer(&kvdroid.ServerOptions{
+		Port:             -1,
+		SlowLogThreshold: time.Nanosecond,
+		SlowLogLen:       2,
+	})
+	go server.Start()
+	defer server.Shutdown()
+
+	client := kvdroid.NewClient(server.Addr())
+	defer client.Close()
+	client.SetBytes("foo", []byte("0123456789"))
+	client.GetBytes("foo")
+	client.GetUint("bar")
+
+	// only the two most recent commands are kept
+	entries := client.SlowLog()
+	util.Equals(t, 2, len(entries), "wrong number of slow log entries")
+	util.Equals(t, "GetUint", entries[0].Command, "wrong command")
+	util.Equals(t, "bar", entries[0].Key, "wrong key")
+	util.Equals(t, "GetBytes", entries[1].Command, "wrong command")
+	util.Equals(t, uint64(15), entries[1].ReplyBytes, "wrong reply size")
+	util.Assert(t, entries[1].Duration > 0, "duration should be recorded")
+	util.Assert(t, entries[1].ClientAddr != "", "client address should be recorded")
+
+	client.ResetSlowLog()
+	entries = client.SlowLog()
+	// commands are recorded once processed, so only the reset is left
+	util.Equals(t, 1, len(entries), "wrong number of slow log entries")
+	util.Equals(t, "SlowLogReset", entries[0].Command, "wrong command")
+}
+
+func TestSlowLogDisabled(t *testing.T) {
+	server := kvdroid.NewServer(&kvdroid.ServerOptions{
+		Port:             -1,
+		SlowLogThreshold: time.Nanosecond,
+		SlowLogLen:       -1,
+	})
+	go server.Start()
+	defer server.Shutdown()
+
+	client := kvdroid.NewClient(server.Addr())
+	defer client.Close()
+	client.SetBytes("foo", []byte("0123456789"))
+	util.Equals(t, 0, len(client.SlowLog()), "slow log should be disabled")
+}
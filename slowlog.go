@@ -0,0 +1,100 @@
+package kvdroid
+
+import (
+	"encoding/json"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	defaultSlowLogThreshold = 10 * time.Millisecond
+	defaultSlowLogLen       = 128
+)
+
+// SlowLogEntry describes a command which exceeded the slow log threshold
+type SlowLogEntry struct {
+	// Time is the time the command started
+	Time     time.Time
+	Command  string
+	Key      string
+	Duration time.Duration
+	// RequestBytes and ReplyBytes count the bytes of the command arguments
+	// and of the reply
+	RequestBytes uint64
+	ReplyBytes   uint64
+	ClientAddr   string
+	Namespace    string
+}
+
+// slowLog is a ring buffer of the most recent slow commands
+type slowLog struct {
+	threshold time.Duration
+	mtx       sync.Mutex
+	entries   []SlowLogEntry
+	// next is the position of the next entry in entries once it is full
+	next int
+}
+
+func newSlowLog(threshold time.Duration, size int) *slowLog {
+	if size < 0 {
+		// an empty log records nothing
+		size = 0
+	}
+	return &slowLog{
+		threshold: threshold,
+		entries:   make([]SlowLogEntry, 0, size),
+	}
+}
+
+// records tells whether a command lasting d is added to the log
+func (l *slowLog) records(d time.Duration) bool {
+	return l.threshold >= 0 && d >= l.threshold && cap(l.entries) > 0
+}
+
+// add records entry if its duration exceeds the threshold
+func (l *slowLog) add(entry SlowLogEntry) {
+	if !l.records(entry.Duration) {
+		return
+	}
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	if len(l.entries) < cap(l.entries) {
+		l.entries = append(l.entries, entry)
+		return
+	}
+	l.entries[l.next] = entry
+	l.next = (l.next + 1) % len(l.entries)
+}
+
+// get returns the entries, most recent first
+func (l *slowLog) get() []SlowLogEntry {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	entries := make([]SlowLogEntry, len(l.entries))
+	for i := range entries {
+		entries[i] = l.entries[(l.next+len(l.entries)-1-i)%len(l.entries)]
+	}
+	return entries
+}
+
+func (l *slowLog) reset() {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	l.entries = l.entries[:0]
+	l.next = 0
+}
+
+// SlowLogGet ...
+func (s *Store) SlowLogGet(conn net.Conn) {
+	data, err := json.Marshal(s.slowLog.get())
+	check(err)
+	try(sendMessage(conn, ackReply))
+	try(sendBytes(conn, data))
+}
+
+// SlowLogReset ...
+func (s *Store) SlowLogReset(conn net.Conn) {
+	s.slowLog.reset()
+	try(sendMessage(conn, ackReply))
+}
@@ -0,0 +1,205 @@
+package kvdroid
+
+import (
+	"net"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// latencyBuckets are the upper bounds of the request latency histograms
+var latencyBuckets = [...]time.Duration{
+	100 * time.Microsecond,
+	500 * time.Microsecond,
+	time.Millisecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	5 * time.Second,
+}
+
+// histogram counts request latencies, the last count is for latencies
+// above all buckets
+type histogram struct {
+	counts [len(latencyBuckets) + 1]uint64
+	sum    uint64
+}
+
+// storeStats holds the server counters, all fields are accessed atomically
+type storeStats struct {
+	bytesIn     uint64
+	bytesOut    uint64
+	connections uint64
+	clients     int64
+	ops         [256]uint64
+	errors      [256]uint64
+	latency     [256]histogram
+}
+
+// observe records a processed command
+func (s *storeStats) observe(cmd Message, d time.Duration, reply Message) {
+	i := sort.Search(len(latencyBuckets), func(i int) bool { return d <= latencyBuckets[i] })
+	atomic.AddUint64(&s.latency[cmd].counts[i], 1)
+	atomic.AddUint64(&s.latency[cmd].sum, uint64(d))
+	if reply.isError() {
+		atomic.AddUint64(&s.errors[cmd], 1)
+	}
+}
+
+// serverConn wraps a client connection on the server side to count the
+// transferred bytes and record the reply to the current request
+type serverConn struct {
+	net.Conn
+	stats *storeStats
+	// reply is the first message sent since startRequest
+	reply    Message
+	awaiting bool
+	// bytes transferred since startRequest
+	requestBytes uint64
+	replyBytes   uint64
+	// threshold negotiated for the compression of byte payloads
+	threshold int
+	// ns is the namespace selected by the client
+	ns *namespace
+	// events are the keyspace events of the current request
+	events      []*Event
+	subscribers *subscribers
+	// pending is data read by watchConn, returned before reading Conn
+	pending []byte
+}
+
+func (c *serverConn) startRequest() {
+	c.reply = 0
+	c.awaiting = true
+	c.requestBytes = 0
+	c.replyBytes = 0
+}
+
+func (c *serverConn) Read(b []byte) (int, error) {
+	if len(c.pending) > 0 {
+		n := copy(b, c.pending)
+		c.pending = c.pending[n:]
+		c.requestBytes += uint64(n)
+		atomic.AddUint64(&c.stats.bytesIn, uint64(n))
+		return n, nil
+	}
+	n, err := c.Conn.Read(b)
+	c.requestBytes += uint64(n)
+	atomic.AddUint64(&c.stats.bytesIn, uint64(n))
+	return n, err
+}
+
+func (c *serverConn) Write(b []byte) (int, error) {
+	if c.awaiting && len(b) > 0 {
+		c.reply = Message(b[0])
+		c.awaiting = false
+	}
+	n, err := c.Conn.Write(b)
+	c.replyBytes += uint64(n)
+	atomic.AddUint64(&c.stats.bytesOut, uint64(n))
+	return n, err
+}
+
+// Info reports the state of a server
+type Info struct {
+	// Uptime is the time elapsed since the server started
+	Uptime time.Duration
+	// ConnectedClients is the number of open client connections
+	ConnectedClients int64
+	// TotalConnections is the number of connections accepted since start
+	TotalConnections uint64
+	// BytesIn and BytesOut count the bytes received from and sent to clients
+	BytesIn  uint64
+	BytesOut uint64
+	// Ops counts the commands processed, by command name
+	Ops map[string]uint64
+	// Keys is the number of distinct keys
+	Keys uint64
+	// Bytes is the total length of the byte values
+	Bytes int64
+	// CompressedBytes is the total length of the byte values stored
+	// compressed, and CompressedSize the memory they use
+	CompressedBytes int64
+	CompressedSize  int64
+	// Namespaces details the content of each namespace
+	Namespaces map[string]NamespaceInfo
+	// Buckets details the content of each bucket, prefixed with their
+	// namespace outside the default one
+	Buckets []BucketInfo
+}
+
+// NamespaceInfo reports the state of a namespace
+type NamespaceInfo struct {
+	// Keys is the number of distinct keys
+	Keys uint64
+	// Bytes is the total length of the byte values
+	Bytes int64
+	// MaxBytes and MaxKeys are the limits of the quota of the namespace,
+	// 0 if unlimited
+	MaxBytes int64
+	MaxKeys  uint64
+}
+
+// BucketInfo reports the state of a bucket
+type BucketInfo struct {
+	Name string
+	// Keys is the number of distinct keys
+	Keys uint64
+	// Bytes is the total length of the byte values
+	Bytes int64
+	// Contended is the number of lock acquisitions which had to wait
+	Contended uint64
+	// CompressedBytes is the total length of the byte values stored
+	// compressed, and CompressedSize the memory they use
+	CompressedBytes int64
+	CompressedSize  int64
+}
+
+// CompressionRatio returns the ratio of the length of the compressed byte
+// values to the memory they use, 0 if none is compressed.
+func (i *Info) CompressionRatio() float64 {
+	if i.CompressedSize == 0 {
+		return 0
+	}
+	return float64(i.CompressedBytes) / float64(i.CompressedSize)
+}
+
+// add accumulates the counters of other into i, prefixing the bucket names
+// with node.
+func (i *Info) add(node string, other *Info) {
+	if i.Uptime == 0 || other.Uptime < i.Uptime {
+		i.Uptime = other.Uptime
+	}
+	i.ConnectedClients += other.ConnectedClients
+	i.TotalConnections += other.TotalConnections
+	i.BytesIn += other.BytesIn
+	i.BytesOut += other.BytesOut
+	if i.Ops == nil {
+		i.Ops = make(map[string]uint64)
+	}
+	for name, n := range other.Ops {
+		i.Ops[name] += n
+	}
+	i.Keys += other.Keys
+	i.Bytes += other.Bytes
+	i.CompressedBytes += other.CompressedBytes
+	i.CompressedSize += other.CompressedSize
+	if i.Namespaces == nil {
+		i.Namespaces = make(map[string]NamespaceInfo)
+	}
+	for name, ns := range other.Namespaces {
+		sum := i.Namespaces[name]
+		sum.Keys += ns.Keys
+		sum.Bytes += ns.Bytes
+		sum.MaxBytes += ns.MaxBytes
+		sum.MaxKeys += ns.MaxKeys
+		i.Namespaces[name] = sum
+	}
+	for _, bucket := range other.Buckets {
+		bucket.Name = node + "/" + bucket.Name
+		i.Buckets = append(i.Buckets, bucket)
+	}
+}
@@ -0,0 +1,221 @@
+// Package sync provides distributed synchronization primitives built on
+// the atomic uint counters of kvdroid. They work through a kvdroid Client
+// or Ring, the parties sharing a primitive use the same name.
+//
+// A zero timeout waits forever. Call Close once the job is done to delete
+// the underlying key.
+package sync
+
+import (
+	"errors"
+	"time"
+
+	"github.com/JCapul/kvdroid"
+)
+
+var (
+	// ErrNoPermits is returned when creating a semaphore without permits
+	ErrNoPermits = errors.New("semaphore without permits")
+	// ErrNotAcquired is returned when releasing a semaphore with no permit
+	// taken
+	ErrNotAcquired = errors.New("semaphore not acquired")
+)
+
+// Counters is the part of the Client and Ring API used by the primitives
+type Counters interface {
+	AddUint(key string, delta uint32) (uint32, error)
+	GetUint(key string) (uint32, error)
+	CompareAndSwapUint(key string, old, val uint32) (bool, error)
+	WaitUintAtLeast(key string, n uint32, timeout time.Duration) (uint32, error)
+	WaitUintAtMost(key string, n uint32, timeout time.Duration) (uint32, error)
+	DelUint(key string) error
+}
+
+var (
+	_ Counters = (*kvdroid.Client)(nil)
+	_ Counters = (*kvdroid.Ring)(nil)
+)
+
+// del deletes a counter, ignoring it was never created
+func del(kv Counters, key string) error {
+	err := kv.DelUint(key)
+	if err == kvdroid.ErrKeyNotFound {
+		return nil
+	}
+	return err
+}
+
+// Barrier blocks its parties until all of them reached it. It is reusable:
+// once all parties passed, the next Wait calls start a new round.
+type Barrier struct {
+	kv      Counters
+	key     string
+	parties uint32
+}
+
+// NewBarrier ...
+func NewBarrier(kv Counters, name string, parties uint32) *Barrier {
+	return &Barrier{
+		kv:      kv,
+		key:     name,
+		parties: parties,
+	}
+}
+
+// Wait blocks until all parties reached the barrier, or returns
+// kvdroid.ErrTimeout once timeout expires. A party which timed out still
+// counts as arrived.
+func (b *Barrier) Wait(timeout time.Duration) error {
+	// the counter holds the total number of arrivals, the round ends once
+	// it reaches the next multiple of parties
+	arrived, err := b.kv.AddUint(b.key, 1)
+	if err != nil {
+		return err
+	}
+	round := (arrived - 1) / b.parties
+	_, err = b.kv.WaitUintAtLeast(b.key, (round+1)*b.parties, timeout)
+	return err
+}
+
+// Close deletes the barrier counter.
+func (b *Barrier) Close() error {
+	return del(b.kv, b.key)
+}
+
+// CountDownLatch blocks its waiters until count events happened.
+type CountDownLatch struct {
+	kv    Counters
+	key   string
+	count uint32
+}
+
+// NewCountDownLatch ...
+func NewCountDownLatch(kv Counters, name string, count uint32) *CountDownLatch {
+	return &CountDownLatch{
+		kv:    kv,
+		key:   name,
+		count: count,
+	}
+}
+
+// CountDown records an event.
+func (l *CountDownLatch) CountDown() error {
+	_, err := l.kv.AddUint(l.key, 1)
+	return err
+}
+
+// Count returns the number of events still expected.
+func (l *CountDownLatch) Count() uint32 {
+	done, err := l.kv.GetUint(l.key)
+	if err == kvdroid.ErrKeyNotFound {
+		return l.count
+	}
+	if done >= l.count {
+		return 0
+	}
+	return l.count - done
+}
+
+// Wait blocks until count events happened, or returns kvdroid.ErrTimeout
+// once timeout expires.
+func (l *CountDownLatch) Wait(timeout time.Duration) error {
+	_, err := l.kv.WaitUintAtLeast(l.key, l.count, timeout)
+	return err
+}
+
+// Close deletes the latch counter.
+func (l *CountDownLatch) Close() error {
+	return del(l.kv, l.key)
+}
+
+// Semaphore limits the number of parties holding it at the same time.
+type Semaphore struct {
+	kv      Counters
+	key     string
+	permits uint32
+}
+
+// NewSemaphore ...
+func NewSemaphore(kv Counters, name string, permits uint32) (*Semaphore, error) {
+	if permits == 0 {
+		return nil, ErrNoPermits
+	}
+	return &Semaphore{
+		kv:      kv,
+		key:     name,
+		permits: permits,
+	}, nil
+}
+
+// TryAcquire takes a permit if one is available and returns true if it
+// did. It fails if the counter cannot be created, such as with
+// kvdroid.ErrQuotaExceeded.
+func (s *Semaphore) TryAcquire() (bool, error) {
+	// make sure the counter exists for CompareAndSwapUint
+	held, err := s.kv.AddUint(s.key, 0)
+	for err == nil && held < s.permits {
+		var swapped bool
+		swapped, err = s.kv.CompareAndSwapUint(s.key, held, held+1)
+		if err == kvdroid.ErrKeyNotFound {
+			held, err = s.kv.AddUint(s.key, 0)
+			continue
+		}
+		if swapped {
+			return true, nil
+		}
+		held, _ = s.kv.GetUint(s.key)
+	}
+	return false, err
+}
+
+// Acquire blocks until it takes a permit, or returns kvdroid.ErrTimeout
+// once timeout expires.
+func (s *Semaphore) Acquire(timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		acquired, err := s.TryAcquire()
+		if err != nil || acquired {
+			return err
+		}
+		wait := time.Duration(0)
+		if timeout > 0 {
+			wait = time.Until(deadline)
+			if wait <= 0 {
+				return kvdroid.ErrTimeout
+			}
+		}
+		_, err = s.kv.WaitUintAtMost(s.key, s.permits-1, wait)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// Release gives back a permit, or returns ErrNotAcquired if no permit is
+// taken.
+func (s *Semaphore) Release() error {
+	for {
+		held, err := s.kv.GetUint(s.key)
+		if err == kvdroid.ErrKeyNotFound || err == nil && held == 0 {
+			return ErrNotAcquired
+		}
+		if err != nil {
+			return err
+		}
+		swapped, err := s.kv.CompareAndSwapUint(s.key, held, held-1)
+		if err == kvdroid.ErrKeyNotFound {
+			return ErrNotAcquired
+		}
+		if err != nil {
+			return err
+		}
+		if swapped {
+			return nil
+		}
+	}
+}
+
+// Close deletes the semaphore counter.
+func (s *Semaphore) Close() error {
+	return del(s.kv, s.key)
+}
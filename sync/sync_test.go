@@ -0,0 +1,134 @@
+package sync_test
+
+import (
+	gosync "sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/JCapul/kvdroid"
+	"github.com/JCapul/kvdroid/sync"
+	"github.com/JCapul/kvdroid/util"
+)
+
+// runParties runs f concurrently with a client per party
+func runParties(server *kvdroid.Server, parties int, f func(i int, client *kvdroid.Client)) {
+	wg := gosync.WaitGroup{}
+	for i := 0; i < parties; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			client := kvdroid.NewClient(server.Addr())
+			defer client.Close()
+			f(i, client)
+		}(i)
+	}
+	wg.Wait()
+}
+
+func initServer() *kvdroid.Server {
+	server := kvdroid.NewServer(&kvdroid.ServerOptions{Port: -1})
+	go server.Start()
+	return server
+}
+
+func TestBarrier(t *testing.T) {
+	server := initServer()
+	defer server.Shutdown()
+
+	var phase1 int32
+	errs := make(chan error, 8)
+	runParties(server, 4, func(i int, client *kvdroid.Client) {
+		barrier := sync.NewBarrier(client, "barrier", 4)
+		atomic.AddInt32(&phase1, 1)
+		errs <- barrier.Wait(time.Second)
+		if atomic.LoadInt32(&phase1) != 4 {
+			t.Errorf("party %d passed the barrier early", i)
+		}
+		// second round
+		errs <- barrier.Wait(time.Second)
+	})
+	close(errs)
+	for err := range errs {
+		util.Ok(t, err)
+	}
+
+	client := kvdroid.NewClient(server.Addr())
+	defer client.Close()
+	barrier := sync.NewBarrier(client, "barrier", 4)
+	err := barrier.Wait(10 * time.Millisecond)
+	util.Equals(t, kvdroid.ErrTimeout, err, "should raise Timeout error")
+	util.Ok(t, barrier.Close())
+	util.Assert(t, !client.Exists("barrier"), "key should be deleted")
+}
+
+func TestCountDownLatch(t *testing.T) {
+	server := initServer()
+	defer server.Shutdown()
+	client := kvdroid.NewClient(server.Addr())
+	defer client.Close()
+
+	latch := sync.NewCountDownLatch(client, "latch", 3)
+	util.Equals(t, uint32(3), latch.Count(), "wrong count")
+	err := latch.Wait(10 * time.Millisecond)
+	util.Equals(t, kvdroid.ErrTimeout, err, "should raise Timeout error")
+
+	runParties(server, 3, func(i int, client *kvdroid.Client) {
+		sync.NewCountDownLatch(client, "latch", 3).CountDown()
+	})
+	util.Ok(t, latch.Wait(time.Second))
+	util.Equals(t, uint32(0), latch.Count(), "wrong count")
+	util.Ok(t, latch.Close())
+}
+
+func TestSemaphore(t *testing.T) {
+	server := initServer()
+	defer server.Shutdown()
+
+	var holders, maxHolders int32
+	runParties(server, 6, func(i int, client *kvdroid.Client) {
+		sem, err := sync.NewSemaphore(client, "sem", 2)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		for j := 0; j < 3; j++ {
+			if err := sem.Acquire(5 * time.Second); err != nil {
+				t.Error(err)
+				return
+			}
+			n := atomic.AddInt32(&holders, 1)
+			for {
+				max := atomic.LoadInt32(&maxHolders)
+				if n <= max || atomic.CompareAndSwapInt32(&maxHolders, max, n) {
+					break
+				}
+			}
+			time.Sleep(time.Millisecond)
+			atomic.AddInt32(&holders, -1)
+			if err := sem.Release(); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	})
+	util.Assert(t, maxHolders <= 2, "too many holders: %d", maxHolders)
+
+	client := kvdroid.NewClient(server.Addr())
+	defer client.Close()
+	_, err := sync.NewSemaphore(client, "sem", 0)
+	util.Equals(t, sync.ErrNoPermits, err, "should raise NoPermits error")
+	sem, err := sync.NewSemaphore(client, "sem", 1)
+	util.Ok(t, err)
+	util.Equals(t, sync.ErrNotAcquired, sem.Release(), "should raise NotAcquired error")
+	acquired, err := sem.TryAcquire()
+	util.Ok(t, err)
+	util.Assert(t, acquired, "permit should be available")
+	acquired, _ = sem.TryAcquire()
+	util.Assert(t, !acquired, "permit should not be available")
+	err = sem.Acquire(10 * time.Millisecond)
+	util.Equals(t, kvdroid.ErrTimeout, err, "should raise Timeout error")
+	util.Ok(t, sem.Release())
+	util.Equals(t, sync.ErrNotAcquired, sem.Release(), "should raise NotAcquired error")
+	util.Ok(t, sem.Close())
+}
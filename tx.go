@@ -0,0 +1,183 @@
+package kvdroid
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync/atomic"
+)
+
+// txConn runs the commands of a transaction against in-memory buffers
+type txConn struct {
+	net.Conn
+	args    *bytes.Reader
+	replies bytes.Buffer
+}
+
+func (c *txConn) Read(b []byte) (int, error) {
+	return c.args.Read(b)
+}
+
+func (c *txConn) Write(b []byte) (int, error) {
+	return c.replies.Write(b)
+}
+
+// Watch ...
+func (s *Store) Watch(bucket *Bucket, key string, conn net.Conn) {
+	try(sendMessage(conn, ackReply))
+	try(sendUint64(conn, bucket.watchVersionOf(key)))
+}
+
+// argKind is the type of an argument of a command
+type argKind int
+
+const (
+	uint32Arg argKind = iota
+	uint64Arg
+	bytesArg
+)
+
+// txArgs lists the arguments following the key of the commands allowed in a
+// transaction, which are all the commands of lockModes
+var txArgs = map[Message][]argKind{
+	getBytesCmd:               nil,
+	getBytesIntoCmd:           {uint32Arg},
+	getBytesRangeCmd:          {uint32Arg, uint32Arg},
+	getBytesRangeIntoCmd:      {uint32Arg, uint32Arg, uint32Arg},
+	setBytesCmd:               {bytesArg},
+	setBytesRangeCmd:          {uint32Arg, bytesArg},
+	delBytesCmd:               nil,
+	truncateBytesCmd:          {uint32Arg},
+	appendBytesCmd:            {bytesArg},
+	setUintCmd:                {uint32Arg},
+	getUintCmd:                nil,
+	setUintIfMaxCmd:           {uint32Arg},
+	delUintCmd:                nil,
+	addUintCmd:                {uint32Arg},
+	setUintIfMinCmd:           {uint32Arg},
+	compareAndSwapUintCmd:     {uint32Arg, uint32Arg},
+	getAndSetUintCmd:          {uint32Arg},
+	setUint64Cmd:              {uint64Arg},
+	getUint64Cmd:              nil,
+	setUint64IfMaxCmd:         {uint64Arg},
+	addUint64Cmd:              {uint64Arg},
+	delUint64Cmd:              nil,
+	setInt64Cmd:               {uint64Arg},
+	getInt64Cmd:               nil,
+	setInt64IfMaxCmd:          {uint64Arg},
+	addInt64Cmd:               {uint64Arg},
+	delInt64Cmd:               nil,
+	existsCmd:                 nil,
+	typeCmd:                   nil,
+	sizeBytesCmd:              nil,
+	statCmd:                   nil,
+	watchCmd:                  nil,
+	getBytesVersionCmd:        nil,
+	getUintVersionCmd:         nil,
+	setBytesIfVersionCmd:      {uint64Arg, bytesArg},
+	setBytesRangeIfVersionCmd: {uint64Arg, uint32Arg, bytesArg},
+	delIfVersionCmd:           {uint64Arg},
+	setBytesCheckedCmd:        {uint32Arg, bytesArg},
+	checksumCmd:               {uint32Arg, uint32Arg},
+}
+
+// checkTxArgs checks that args holds exactly the arguments of cmds, so that
+// a transaction never stops halfway on a malformed argument
+func checkTxArgs(cmds []Message, args []byte) error {
+	r := bytes.NewReader(args)
+	for _, cmd := range cmds {
+		for _, kind := range txArgs[cmd] {
+			size := int64(4)
+			if kind == uint64Arg {
+				size = 8
+			}
+			if int64(r.Len()) < size {
+				return fmt.Errorf("Missing argument of %s in transaction", cmd)
+			}
+			if kind == bytesArg {
+				n, _ := readUint32(r)
+				size = int64(n)
+				if int64(r.Len()) < size {
+					return fmt.Errorf("Missing argument of %s in transaction", cmd)
+				}
+			}
+			r.Seek(size, io.SeekCurrent)
+		}
+	}
+	if r.Len() > 0 {
+		return fmt.Errorf("Unexpected arguments in transaction")
+	}
+	return nil
+}
+
+// Exec runs the commands of a transaction while holding the locks of all the
+// buckets involved, unless one of the watched keys changed version. The
+// commands and their arguments are all checked before running any of them, an
+// invalid transaction is read entirely and rejected.
+func (s *Store) Exec(conn net.Conn) {
+	n, err := readUint32(conn)
+	check(err)
+	watched := make(map[string]uint64, n)
+	for i := uint32(0); i < n; i++ {
+		key, err := readString(conn)
+		check(err)
+		watched[key], err = readUint64(conn)
+		check(err)
+	}
+	n, err = readUint32(conn)
+	check(err)
+	cmds := make([]Message, n)
+	keys := make([]string, n)
+	var invalid error
+	for i := range cmds {
+		cmds[i], err = readMessage(conn)
+		check(err)
+		if _, ok := txArgs[cmds[i]]; !ok && invalid == nil {
+			invalid = fmt.Errorf("Command not allowed in transaction: %s", cmds[i])
+		}
+		keys[i], err = readString(conn)
+		check(err)
+	}
+	args, err := readBytes(conn)
+	check(err)
+	if invalid == nil {
+		invalid = checkTxArgs(cmds, args)
+	}
+	if invalid != nil {
+		log.Printf("Transaction rejected for client %v: %v", conn.RemoteAddr(), invalid)
+		try(sendMessage(conn, errTxInvalidReply))
+		return
+	}
+
+	tx := &txConn{Conn: conn, args: bytes.NewReader(args)}
+	if !s.runTx(namespaceOf(conn), watched, cmds, keys, tx) {
+		try(sendMessage(conn, errTxAbortedReply))
+		return
+	}
+	try(sendMessage(conn, ackReply))
+	try(sendBytes(conn, tx.replies.Bytes()))
+}
+
+// runTx runs the commands of a transaction on tx and reports whether they
+// ran, that is whether no watched key changed version
+func (s *Store) runTx(ns *namespace, watched map[string]uint64, cmds []Message, keys []string, tx *txConn) bool {
+	involved := append(make([]string, 0, len(keys)+len(watched)), keys...)
+	for key := range watched {
+		involved = append(involved, key)
+	}
+	buckets := ns.lockKeys(involved...)
+	defer unlockBuckets(buckets)
+
+	for key, version := range watched {
+		if ns.getBucket(key).watchVersionOf(key) != version {
+			return false
+		}
+	}
+	for i, cmd := range cmds {
+		atomic.AddUint64(&s.stats.ops[cmd], 1)
+		s.execute(cmd, ns.getBucket(keys[i]), keys[i], tx)
+	}
+	return true
+}
@@ -0,0 +1,95 @@
+package kvdroid
+
+import (
+	"net"
+)
+
+// detached holds the byte values removed from a bucket by Unlink, which are
+// still accounted for in the bucket until they are released
+type detached struct {
+	data  [][]byte
+	blobs []*blob
+	// flushes is the number of flushes of the bucket when the values were
+	// detached, a flush accounts for them
+	flushes uint64
+}
+
+// detach deletes the values of key of the types in typ like del, except that
+// its byte value is only removed from the bucket and added to values. It
+// must be called with the write lock held.
+func (b *Bucket) detach(key string, typ ValueType, values *detached) bool {
+	found := b.typeOf(key) & typ
+	if found == 0 {
+		return false
+	}
+	if found&TypeBytes != 0 {
+		if v, ok := b.blobs[key]; ok {
+			values.blobs = append(values.blobs, v)
+			delete(b.blobs, key)
+		} else {
+			values.data = append(values.data, b.bytedata[key])
+			delete(b.bytedata, key)
+		}
+	}
+	b.del(key, found&^TypeBytes)
+	b.forget(key)
+	return true
+}
+
+// release removes the detached values from the accounting of the bucket and
+// drops them, it takes the write lock
+func (b *Bucket) release(values *detached) {
+	var size, packedBytes, packedSize int64
+	for _, data := range values.data {
+		size += int64(len(data))
+	}
+	for _, v := range values.blobs {
+		packedBytes += int64(v.size)
+		packedSize += int64(v.stored)
+	}
+	b.lock()
+	defer b.unlock()
+	if b.flushes != values.flushes {
+		return
+	}
+	b.addBytes(-size - packedBytes)
+	b.packedBytes -= packedBytes
+	b.packedSize -= packedSize
+}
+
+// Unlink deletes the values of some types of several keys. The keys are
+// grouped by bucket so that each bucket is locked once, and only for the
+// time needed to detach the values from their keys: the byte values are
+// released in the background, so the byte usage of the namespace decreases
+// shortly after the reply.
+func (s *Store) Unlink(conn net.Conn) {
+	typ, err := readUint32(conn)
+	check(err)
+	keys, err := readStrings(conn)
+	check(err)
+
+	ns := namespaceOf(conn)
+	byBucket := make(map[*Bucket][]string)
+	for _, key := range keys {
+		bucket := ns.getBucket(key)
+		byBucket[bucket] = append(byBucket[bucket], key)
+	}
+	var unlinked uint32
+	for bucket, keys := range byBucket {
+		values := &detached{}
+		bucket.lock()
+		values.flushes = bucket.flushes
+		for _, key := range keys {
+			if bucket.detach(key, ValueType(typ), values) {
+				notify(conn, EventDel, key)
+				unlinked++
+			}
+		}
+		bucket.unlock()
+		if len(values.data) > 0 || len(values.blobs) > 0 {
+			go bucket.release(values)
+		}
+	}
+	try(sendMessage(conn, ackReply))
+	try(sendUint32(conn, unlinked))
+}
@@ -0,0 +1,82 @@
+package kvdroid
+
+import (
+	"io"
+	"net"
+)
+
+// GetBytesVersion ...
+func (s *Store) GetBytesVersion(bucket *Bucket, key string, conn net.Conn) {
+	data, ok := bucket.bytesOf(key)
+	if !ok {
+		try(sendMessage(conn, errNoKeyReply))
+	} else {
+		try(sendMessage(conn, ackReply))
+		try(sendUint64(conn, bucket.versionOf(key)))
+		try(sendBytes(conn, data))
+	}
+}
+
+// GetUintVersion ...
+func (s *Store) GetUintVersion(bucket *Bucket, key string, conn net.Conn) {
+	val, ok := bucket.uintdata[key]
+	if !ok {
+		try(sendMessage(conn, errNoKeyReply))
+	} else {
+		try(sendMessage(conn, ackReply))
+		try(sendUint64(conn, bucket.versionOf(key)))
+		try(sendUint32(conn, val))
+	}
+}
+
+// SetBytesIfVersion ...
+func (s *Store) SetBytesIfVersion(bucket *Bucket, key string, conn net.Conn) {
+	version, err := readUint64(conn)
+	check(err)
+	data, err := readBytes(conn)
+	check(err)
+	if bucket.versionOf(key) != version {
+		try(sendMessage(conn, errVersionConflictReply))
+	} else if !bucket.allows(key, uint32(len(data))) {
+		try(sendMessage(conn, errQuotaExceededReply))
+	} else {
+		bucket.setBytes(key, data)
+		notify(conn, EventSet, key)
+		try(sendMessage(conn, ackReply))
+		try(sendUint64(conn, bucket.versionOf(key)))
+	}
+}
+
+// SetBytesRangeIfVersion ...
+func (s *Store) SetBytesRangeIfVersion(bucket *Bucket, key string, conn net.Conn) {
+	version, err := readUint64(conn)
+	check(err)
+	if bucket.versionOf(key) != version {
+		// skip the range
+		_, err := readUint32(conn)
+		check(err)
+		size, payload, err := readPayload(conn)
+		check(err)
+		_, err = io.CopyN(io.Discard, payload, int64(size))
+		check(err)
+		try(sendMessage(conn, errVersionConflictReply))
+	} else if s.setBytesRange(bucket, key, conn) {
+		try(sendUint64(conn, bucket.versionOf(key)))
+	}
+}
+
+// DelIfVersion deletes all the values of key
+func (s *Store) DelIfVersion(bucket *Bucket, key string, conn net.Conn) {
+	version, err := readUint64(conn)
+	check(err)
+	actualVersion := bucket.versionOf(key)
+	if actualVersion == 0 && version == 0 {
+		try(sendMessage(conn, errNoKeyReply))
+	} else if actualVersion != version {
+		try(sendMessage(conn, errVersionConflictReply))
+	} else {
+		bucket.del(key, TypeAny)
+		notify(conn, EventDel, key)
+		try(sendMessage(conn, ackReply))
+	}
+}
@@ -0,0 +1,169 @@
+package kvdroid
+
+import (
+	"errors"
+	"net"
+	"os"
+	"time"
+)
+
+// addWaiter returns a channel closed on the next modification of key, it
+// must be called with the write lock held
+func (b *Bucket) addWaiter(key string) chan struct{} {
+	waiters, ok := b.waiters[key]
+	if !ok {
+		waiters = make(map[chan struct{}]struct{})
+		b.waiters[key] = waiters
+	}
+	ch := make(chan struct{})
+	waiters[ch] = struct{}{}
+	return ch
+}
+
+// removeWaiter drops a waiter which gave up, it must be called with the
+// write lock held
+func (b *Bucket) removeWaiter(key string, ch chan struct{}) {
+	delete(b.waiters[key], ch)
+	if len(b.waiters[key]) == 0 {
+		delete(b.waiters, key)
+	}
+}
+
+// wake signals the waiters of key, it must be called with the write lock
+// held
+func (b *Bucket) wake(key string) {
+	for ch := range b.waiters[key] {
+		close(ch)
+	}
+	delete(b.waiters, key)
+}
+
+// watchConn returns a channel closed if the client disconnects while the
+// server blocks on its request. stop ends the watch before the connection is
+// read again, data received meanwhile is kept for the next request.
+func watchConn(conn net.Conn) (closed <-chan struct{}, stop func()) {
+	c := conn.(*serverConn)
+	disconnected := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		b := make([]byte, 1)
+		n, err := c.Conn.Read(b)
+		c.pending = append(c.pending, b[:n]...)
+		if err != nil && !errors.Is(err, os.ErrDeadlineExceeded) {
+			close(disconnected)
+		}
+	}()
+	stop = func() {
+		c.Conn.SetReadDeadline(time.Now())
+		<-done
+		c.Conn.SetReadDeadline(time.Time{})
+	}
+	return disconnected, stop
+}
+
+// errDisconnected is returned by wait when the client disconnects
+var errDisconnected = errors.New("Client disconnected")
+
+// wait blocks until cond holds or timeout expires, a zero timeout waits
+// forever. cond is evaluated with the write lock held, which wait returns
+// with. It returns errDisconnected without waiting further if the client of
+// conn disconnects.
+func (s *Store) wait(bucket *Bucket, key string, timeout time.Duration, conn net.Conn, cond func() bool) (bool, error) {
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	var closed <-chan struct{}
+	bucket.lock()
+	for !cond() {
+		if closed == nil {
+			var stop func()
+			closed, stop = watchConn(conn)
+			defer stop()
+		}
+		ch := bucket.addWaiter(key)
+		bucket.unlock()
+		select {
+		case <-ch:
+			bucket.lock()
+		case <-expired:
+			bucket.lock()
+			bucket.removeWaiter(key, ch)
+			return cond(), nil
+		case <-closed:
+			bucket.lock()
+			bucket.removeWaiter(key, ch)
+			return false, errDisconnected
+		case <-s.done:
+			bucket.lock()
+			bucket.removeWaiter(key, ch)
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// WaitUintAtLeast ...
+func (s *Store) WaitUintAtLeast(bucket *Bucket, key string, conn net.Conn) {
+	n, err := readUint32(conn)
+	check(err)
+	timeout, err := readInt64(conn)
+	check(err)
+	reached, err := s.wait(bucket, key, time.Duration(timeout), conn, func() bool {
+		val, ok := bucket.uintdata[key]
+		return ok && val >= n
+	})
+	defer bucket.unlock()
+	if err != nil {
+		return
+	}
+	if !reached {
+		try(sendMessage(conn, errTimeoutReply))
+	} else {
+		try(sendMessage(conn, ackReply))
+		try(sendUint32(conn, bucket.uintdata[key]))
+	}
+}
+
+// WaitUintAtMost ...
+func (s *Store) WaitUintAtMost(bucket *Bucket, key string, conn net.Conn) {
+	n, err := readUint32(conn)
+	check(err)
+	timeout, err := readInt64(conn)
+	check(err)
+	reached, err := s.wait(bucket, key, time.Duration(timeout), conn, func() bool {
+		val, ok := bucket.uintdata[key]
+		return ok && val <= n
+	})
+	defer bucket.unlock()
+	if err != nil {
+		return
+	}
+	if !reached {
+		try(sendMessage(conn, errTimeoutReply))
+	} else {
+		try(sendMessage(conn, ackReply))
+		try(sendUint32(conn, bucket.uintdata[key]))
+	}
+}
+
+// WaitExists ...
+func (s *Store) WaitExists(bucket *Bucket, key string, conn net.Conn) {
+	timeout, err := readInt64(conn)
+	check(err)
+	reached, err := s.wait(bucket, key, time.Duration(timeout), conn, func() bool {
+		return bucket.typeOf(key) != 0
+	})
+	defer bucket.unlock()
+	if err != nil {
+		return
+	}
+	if !reached {
+		try(sendMessage(conn, errTimeoutReply))
+	} else {
+		try(sendMessage(conn, ackReply))
+	}
+}